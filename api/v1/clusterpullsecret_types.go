@@ -23,14 +23,80 @@ import (
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
+// Condition types reported in ClusterPullSecretStatus
+const (
+	// ConditionReady is true when the pull secret has been synced to
+	// every namespace in scope
+	ConditionReady = "Ready"
+
+	// ConditionSeedSecretFound is true when the seed secret referenced
+	// by the ClusterPullSecret could be fetched
+	ConditionSeedSecretFound = "SeedSecretFound"
+
+	// ConditionDegraded is true when one or more namespaces could not
+	// be synced
+	ConditionDegraded = "Degraded"
+
+	// ConditionStalled is true when the ClusterPullSecret cannot make
+	// progress until it, or an object it references, is changed
+	ConditionStalled = "Stalled"
+)
+
+// MaxNamespaceFailures is the maximum number of failing namespaces
+// recorded in ClusterPullSecretStatus
+const MaxNamespaceFailures = 10
+
+// NamespaceFailure records why the pull secret could not be synced
+// to a namespace
+type NamespaceFailure struct {
+	// Namespace which failed to sync
+	Namespace string `json:"namespace"`
+
+	// Reason for the failure
+	Reason string `json:"reason"`
+}
+
 // ClusterPullSecretStatus defines the observed state of ClusterPullSecret
 type ClusterPullSecretStatus struct {
+	// ObservedGeneration is the most recent generation observed by the controller
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions describe the current state of the ClusterPullSecret
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// SyncedNamespaces is the number of namespaces holding a copy of the pull secret
+	SyncedNamespaces int32 `json:"syncedNamespaces"`
+
+	// FailedNamespaces is the number of namespaces which could not be synced
+	FailedNamespaces int32 `json:"failedNamespaces"`
+
+	// IgnoredNamespaces is the number of namespaces which were skipped
+	IgnoredNamespaces int32 `json:"ignoredNamespaces"`
+
+	// ExpiresAt is when the credentials generated by the provider expire
+	// +optional
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+
+	// Failures lists up to MaxNamespaceFailures namespaces which could not be synced
+	// +optional
+	// +kubebuilder:validation:MaxItems=10
+	Failures []NamespaceFailure `json:"failures,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:resource:scope=Cluster
+//+kubebuilder:subresource:status
 //+kubebuilder:printcolumn:name="SecretName",type=string,JSONPath=`.spec.secretRef.name`
 //+kubebuilder:printcolumn:name="SecretNamespace",type=string,JSONPath=`.spec.secretRef.namespace`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Synced",type=integer,JSONPath=`.status.syncedNamespaces`
+//+kubebuilder:printcolumn:name="Failed",type=integer,JSONPath=`.status.failedNamespaces`
+//+kubebuilder:printcolumn:name="Ignored",type=integer,JSONPath=`.status.ignoredNamespaces`,priority=1
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // ClusterPullSecret is the Schema for the clusterpullsecrets API
 type ClusterPullSecret struct {
@@ -53,9 +119,323 @@ type ObjectMeta struct {
 	Namespace string `json:"namespace,omitempty"`
 }
 
+// Mode determines which namespaces receive the pull secret
+// +kubebuilder:validation:Enum=OptOut;OptIn
+type Mode string
+
+const (
+	// ModeOptOut provisions every namespace, unless it is annotated
+	// with alexellis.io/registry-creds.ignore
+	ModeOptOut Mode = "OptOut"
+
+	// ModeOptIn only provisions namespaces which list the ClusterPullSecret
+	// in their alexellis.io/registry-creds.include annotation
+	ModeOptIn Mode = "OptIn"
+)
+
 // ClusterPullSecretSpec defines the desired state of ClusterPullSecret
 type ClusterPullSecretSpec struct {
 	SecretRef *ObjectMeta `json:"secretRef,omitempty"`
+
+	// SecretRefs lists additional seed secrets. The auths of each seed are
+	// merged into a single .dockerconfigjson, and when a registry appears in
+	// more than one seed, the first seed takes precedence, starting with SecretRef.
+	// +optional
+	SecretRefs []ObjectMeta `json:"secretRefs,omitempty"`
+
+	// Provider generates registry credentials, i.e. from a cloud provider,
+	// which are merged ahead of any seed secrets
+	// +optional
+	Provider *Provider `json:"provider,omitempty"`
+
+	// Source reads registry credentials from an external store, which
+	// are merged ahead of any seed secrets
+	// +optional
+	Source *Source `json:"source,omitempty"`
+
+	// Registries filters which registries from the auths of the seed
+	// secrets are propagated. When empty, all registries are propagated.
+	// +optional
+	Registries *RegistryFilter `json:"registries,omitempty"`
+
+	// Mode is either OptOut or OptIn, when empty the default mode
+	// of the controller is used
+	// +optional
+	Mode Mode `json:"mode,omitempty"`
+
+	// NamespaceSelector limits the namespaces which receive the pull secret
+	// to those with matching labels. When empty, all namespaces are selected.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// ServiceAccountSelector limits the ServiceAccounts which have the pull
+	// secret appended to their imagePullSecrets. When empty, all
+	// ServiceAccounts within a selected namespace are updated.
+	// +optional
+	ServiceAccountSelector *ServiceAccountSelector `json:"serviceAccountSelector,omitempty"`
+
+	// CredentialProvider publishes the credentials to the kubelet credential
+	// provider plugin on every node, when the controller is started with
+	// --credential-provider-secret. Any Pod on any node can then pull with
+	// them, regardless of Mode, NamespaceSelector or ServiceAccountSelector.
+	// +optional
+	CredentialProvider bool `json:"credentialProvider,omitempty"`
+}
+
+// Provider generates short-lived registry credentials, which are
+// refreshed by the controller before they expire
+type Provider struct {
+	// ECR fetches an authorization token for Amazon Elastic Container Registry
+	// +optional
+	ECR *ECRProvider `json:"ecr,omitempty"`
+
+	// GCP exchanges a service account key for an access token for
+	// Google Artifact Registry or Google Container Registry
+	// +optional
+	GCP *GCPProvider `json:"gcp,omitempty"`
+
+	// ACR exchanges an Azure AD token for an Azure Container Registry
+	// refresh token
+	// +optional
+	ACR *ACRProvider `json:"acr,omitempty"`
+}
+
+// ECRProvider fetches an authorization token for Amazon Elastic
+// Container Registry, which is valid for 12 hours. The URL of the ECR
+// API can only be overridden with AWS_ENDPOINT_URL_ECR of the controller.
+type ECRProvider struct {
+	// Region of the registries, i.e. eu-west-1
+	// +kubebuilder:validation:Pattern=`^[a-z]{2}(-[a-z]+)+-[0-9]+$`
+	Region string `json:"region"`
+
+	// RegistryIDs are the AWS account IDs of the registries. When empty,
+	// the registry of the account of the credentials is used.
+	// +optional
+	RegistryIDs []string `json:"registryIDs,omitempty"`
+
+	// CredentialsRef references a Secret with the keys aws_access_key_id,
+	// aws_secret_access_key and optionally aws_session_token. When empty,
+	// the controller's own credentials are used from its environment, or
+	// from IAM Roles for Service Accounts (IRSA).
+	// +optional
+	CredentialsRef *ObjectMeta `json:"credentialsRef,omitempty"`
+}
+
+// GCPProvider exchanges a service account key for an OAuth2 access token,
+// which is valid for 1 hour and used with the oauth2accesstoken username
+type GCPProvider struct {
+	// Registries to write the access token for, i.e. gcr.io or
+	// europe-docker.pkg.dev
+	// +kubebuilder:validation:MinItems=1
+	Registries []string `json:"registries"`
+
+	// CredentialsRef references a Secret holding the JSON key of a
+	// Google Cloud service account
+	CredentialsRef *ObjectMeta `json:"credentialsRef"`
+
+	// CredentialsKey is the key of the Secret holding the service account
+	// key, defaults to key.json
+	// +optional
+	CredentialsKey string `json:"credentialsKey,omitempty"`
+
+	// TokenURL overrides the OAuth2 token endpoint, otherwise the
+	// token_uri of the service account key is used
+	// +optional
+	TokenURL string `json:"tokenURL,omitempty"`
+}
+
+// ACRProvider signs into Azure AD as a service principal, or with a
+// federated token from Azure Workload Identity, then exchanges the token
+// for a refresh token of the registry, which is valid for 3 hours. The
+// federated token and Azure AD endpoint are read from AZURE_FEDERATED_TOKEN_FILE
+// and AZURE_AUTHORITY_HOST of the controller.
+type ACRProvider struct {
+	// Registry is the login server of the registry, i.e. example.azurecr.io
+	Registry string `json:"registry"`
+
+	// TenantID of the Azure AD tenant, defaults to AZURE_TENANT_ID
+	// of the controller
+	// +optional
+	TenantID string `json:"tenantID,omitempty"`
+
+	// ClientID of the service principal or managed identity, defaults
+	// to AZURE_CLIENT_ID of the controller
+	// +optional
+	ClientID string `json:"clientID,omitempty"`
+
+	// CredentialsRef references a Secret with the client secret of the
+	// service principal under the key client_secret
+	// +optional
+	CredentialsRef *ObjectMeta `json:"credentialsRef,omitempty"`
+}
+
+// Source reads registry credentials from an external store, and reads
+// them again on an interval so that changes are propagated
+type Source struct {
+	// Vault reads credentials from a HashiCorp Vault KV version 2 secret
+	// +optional
+	Vault *VaultSource `json:"vault,omitempty"`
+
+	// HTTP reads credentials from a JSON endpoint, such as a credential broker
+	// +optional
+	HTTP *HTTPSource `json:"http,omitempty"`
+}
+
+// HTTPSource polls an endpoint which returns registry credentials as JSON.
+// Fields are selected from the response with JSONPath expressions.
+type HTTPSource struct {
+	// URL of the endpoint, which is called with a GET request
+	URL string `json:"url"`
+
+	// CABundle is a PEM encoded CA bundle used to verify the endpoint,
+	// otherwise the system roots are used
+	// +optional
+	CABundle []byte `json:"caBundle,omitempty"`
+
+	// BearerTokenSecretRef references a Secret with a token under the key
+	// token, which is sent in the Authorization header
+	// +optional
+	BearerTokenSecretRef *ObjectMeta `json:"bearerTokenSecretRef,omitempty"`
+
+	// Mapping selects the credentials from the response
+	// +optional
+	Mapping *HTTPMapping `json:"mapping,omitempty"`
+
+	// RefreshInterval is how often the endpoint is polled when the response
+	// has no expiry, defaults to 5m
+	// +optional
+	RefreshInterval *metav1.Duration `json:"refreshInterval,omitempty"`
+}
+
+// HTTPMapping holds JSONPath expressions, i.e. {.data.username}, which
+// select the credentials from the response of an HTTPSource
+type HTTPMapping struct {
+	// Registry expression, defaults to {.registry}
+	// +optional
+	Registry string `json:"registry,omitempty"`
+
+	// Username expression, defaults to {.username}
+	// +optional
+	Username string `json:"username,omitempty"`
+
+	// Password expression, defaults to {.password}
+	// +optional
+	Password string `json:"password,omitempty"`
+
+	// ExpiresAt expression, defaults to {.expiresAt}. The value is either
+	// an RFC 3339 timestamp or seconds since the Unix epoch, and when it is
+	// missing the endpoint is polled on the refresh interval.
+	// +optional
+	ExpiresAt string `json:"expiresAt,omitempty"`
+}
+
+// VaultSource reads credentials from a secret of the KV version 2 secrets
+// engine of HashiCorp Vault. The secret either holds a complete
+// .dockerconfigjson, or a username and password for a single registry.
+type VaultSource struct {
+	// Address of the Vault server, defaults to VAULT_ADDR of the controller.
+	// With the Kubernetes auth method, the address must be VAULT_ADDR or one
+	// of VAULT_ALLOWED_ADDRS of the controller, so that the ServiceAccount
+	// token of the controller is only sent to a server chosen by the cluster
+	// admin. Any address may be used with a tokenSecretRef.
+	// +optional
+	Address string `json:"address,omitempty"`
+
+	// Namespace of Vault Enterprise to read from
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// Mount of the KV version 2 secrets engine, defaults to secret
+	// +optional
+	Mount string `json:"mount,omitempty"`
+
+	// Path of the secret within the mount, i.e. registries/ghcr
+	Path string `json:"path"`
+
+	// Keys maps the fields of the Vault secret to registry credentials
+	// +optional
+	Keys *VaultKeys `json:"keys,omitempty"`
+
+	// Auth configures how the controller authenticates to Vault
+	Auth VaultAuth `json:"auth"`
+
+	// RefreshInterval is how often the secret is read again, defaults to 5m
+	// +optional
+	RefreshInterval *metav1.Duration `json:"refreshInterval,omitempty"`
+}
+
+// VaultKeys maps the fields of a Vault secret to registry credentials.
+// When the DockerConfigJSON field is present it is used as-is, otherwise
+// the remaining fields are combined into an entry for a single registry.
+type VaultKeys struct {
+	// DockerConfigJSON field, defaults to .dockerconfigjson
+	// +optional
+	DockerConfigJSON string `json:"dockerConfigJSON,omitempty"`
+
+	// Server field, defaults to server, when the field is missing
+	// https://index.docker.io/v1/ is used
+	// +optional
+	Server string `json:"server,omitempty"`
+
+	// Username field, defaults to username
+	// +optional
+	Username string `json:"username,omitempty"`
+
+	// Password field, defaults to password
+	// +optional
+	Password string `json:"password,omitempty"`
+
+	// Email field, defaults to email
+	// +optional
+	Email string `json:"email,omitempty"`
+}
+
+// VaultAuth configures either the Kubernetes auth method of Vault,
+// or a token read from a Secret
+type VaultAuth struct {
+	// Kubernetes logs in with the ServiceAccount token of the controller
+	// +optional
+	Kubernetes *VaultKubernetesAuth `json:"kubernetes,omitempty"`
+
+	// TokenSecretRef references a Secret with a Vault token under the key token
+	// +optional
+	TokenSecretRef *ObjectMeta `json:"tokenSecretRef,omitempty"`
+}
+
+// VaultKubernetesAuth logs into the Kubernetes auth method of Vault
+type VaultKubernetesAuth struct {
+	// Role of the auth method to log in as
+	Role string `json:"role"`
+
+	// Mount of the auth method, defaults to kubernetes
+	// +optional
+	Mount string `json:"mount,omitempty"`
+}
+
+// RegistryFilter selects registries by host, i.e. ghcr.io or
+// *.dkr.ecr.eu-west-1.amazonaws.com, with glob patterns supported.
+type RegistryFilter struct {
+	// Allow lists the registries to propagate. When empty, all registries
+	// are allowed.
+	// +optional
+	Allow []string `json:"allow,omitempty"`
+
+	// Deny lists the registries which are not propagated, and takes
+	// precedence over Allow.
+	// +optional
+	Deny []string `json:"deny,omitempty"`
+}
+
+// ServiceAccountSelector selects ServiceAccounts by label or by name. A
+// ServiceAccount is selected when it matches either LabelSelector or Names.
+type ServiceAccountSelector struct {
+	// LabelSelector matches ServiceAccounts by their labels
+	// +optional
+	LabelSelector *metav1.LabelSelector `json:"labelSelector,omitempty"`
+
+	// Names of ServiceAccounts to select
+	// +optional
+	Names []string `json:"names,omitempty"`
 }
 
 //+kubebuilder:object:root=true
@@ -0,0 +1,79 @@
+/*
+
+
+Licensed under the Apache License, Release 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// credential-provider is a kubelet credential provider plugin, which
+// answers image pull requests with the credentials of ClusterPullSecrets
+// from a file on the node. The file is kept up to date by running
+// credential-provider sync in a DaemonSet on each node.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"alexellis/registry-creds/credentialprovider"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sync" {
+		runSync(os.Args[2:])
+		return
+	}
+
+	var configFile string
+	var cacheDuration time.Duration
+	flag.StringVar(&configFile, "config", "/etc/registry-creds/config.json",
+		"The .dockerconfigjson file written by credential-provider sync.")
+	flag.DurationVar(&cacheDuration, "cache-duration", 5*time.Minute,
+		"How long the kubelet caches the credentials of a response.")
+	flag.Parse()
+
+	provider := &credentialprovider.Provider{
+		ConfigFile:    configFile,
+		CacheDuration: cacheDuration,
+	}
+
+	if err := provider.Run(os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "registry-creds credential-provider: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// runSync merges the Secret written by the controller into the file
+// read by the plugin, until the process is stopped
+func runSync(args []string) {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	from := flags.String("from", "/var/run/registry-creds",
+		"The directory where the Secret written with --credential-provider-secret is mounted.")
+	to := flags.String("to", "/host/etc/registry-creds/config.json",
+		"The file on the node which is read by the plugin.")
+	interval := flags.Duration("interval", 30*time.Second,
+		"How often to check the Secret for changes.")
+	flags.Parse(args)
+
+	for {
+		written, err := credentialprovider.Sync(*from, *to)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "registry-creds credential-provider sync: %s\n", err)
+		} else if written {
+			fmt.Printf("wrote %s\n", *to)
+		}
+
+		time.Sleep(*interval)
+	}
+}
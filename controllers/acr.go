@@ -0,0 +1,256 @@
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	v1 "alexellis/registry-creds/api/v1"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// acrRefreshTokenUsername is the username used by ACR to
+// accept a refresh token as a password
+const acrRefreshTokenUsername = "00000000-0000-0000-0000-000000000000"
+
+// acrClientSecretKey is the key of the Secret referenced
+// by ACRProvider.CredentialsRef
+const acrClientSecretKey = "client_secret"
+
+const acrDefaultAuthorityHost = "https://login.microsoftonline.com/"
+
+// acrEndpointEnv overrides the URL used for the token exchange, such as
+// for a local stand-in of ACR. Without it, the exchange is only sent to
+// the login server of a registry within one of acrRegistryDomains.
+const acrEndpointEnv = "ACR_ENDPOINT_URL"
+
+// acrRegistryDomains are the domains of the login servers of ACR
+var acrRegistryDomains = []string{
+	".azurecr.io",
+	".azurecr.cn",
+	".azurecr.us",
+}
+
+const acrScope = "https://management.azure.com/.default"
+
+// acrRefreshTokenLifetime is assumed when the expiry
+// cannot be read from a refresh token
+const acrRefreshTokenLifetime = 3 * time.Hour
+
+type azureTokenResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+type acrExchangeResponse struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// acrSource fetches credentials for Azure Container Registry
+type acrSource struct {
+	client.Client
+}
+
+func newACRSource(c client.Client) CredentialSource {
+	return &acrSource{Client: c}
+}
+
+func (s *acrSource) Name() string {
+	return "acr"
+}
+
+func (s *acrSource) Configured(clusterPullSecret v1.ClusterPullSecret) bool {
+	return clusterPullSecret.Spec.Provider != nil && clusterPullSecret.Spec.Provider.ACR != nil
+}
+
+// Credentials signs into Azure AD, then exchanges the access token
+// for a refresh token of the registry.
+func (s *acrSource) Credentials(ctx context.Context, clusterPullSecret v1.ClusterPullSecret) ([]byte, time.Time, error) {
+	provider := clusterPullSecret.Spec.Provider.ACR
+	if provider.Registry == "" {
+		return nil, time.Time{}, terminalErrorf("a registry is required for the acr provider")
+	}
+
+	endpoint := os.Getenv(acrEndpointEnv)
+	if endpoint == "" {
+		if !acrRegistry(provider.Registry) {
+			return nil, time.Time{}, terminalErrorf("registry %s is not the login server of an Azure Container Registry, i.e. example.azurecr.io",
+				provider.Registry)
+		}
+		endpoint = "https://" + provider.Registry
+	}
+
+	accessToken, tenantID, err := s.azureAccessToken(ctx, provider)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "access_token")
+	form.Set("service", provider.Registry)
+	form.Set("tenant", tenantID)
+	form.Set("access_token", accessToken)
+
+	exchange := acrExchangeResponse{}
+	if err := postForm(ctx, strings.TrimSuffix(endpoint, "/")+"/oauth2/exchange", form, &exchange); err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "unable to exchange Azure AD token for an ACR refresh token")
+	}
+
+	if exchange.RefreshToken == "" {
+		return nil, time.Time{}, fmt.Errorf("no refresh_token returned by ACR token exchange")
+	}
+
+	expiry := jwtExpiry(exchange.RefreshToken)
+	if expiry.IsZero() {
+		expiry = time.Now().Add(acrRefreshTokenLifetime)
+	}
+
+	config := &dockerConfigJSON{
+		Auths: map[string]dockerConfigEntry{
+			provider.Registry: {
+				Username: acrRefreshTokenUsername,
+				Password: exchange.RefreshToken,
+				Auth:     base64.StdEncoding.EncodeToString([]byte(acrRefreshTokenUsername + ":" + exchange.RefreshToken)),
+			},
+		},
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return data, expiry, nil
+}
+
+// azureAccessToken uses the client credentials flow of Azure AD with
+// either a client secret, or a federated token as a client assertion.
+func (s *acrSource) azureAccessToken(ctx context.Context, provider *v1.ACRProvider) (string, string, error) {
+	tenantID := provider.TenantID
+	if tenantID == "" {
+		tenantID = os.Getenv("AZURE_TENANT_ID")
+	}
+	clientID := provider.ClientID
+	if clientID == "" {
+		clientID = os.Getenv("AZURE_CLIENT_ID")
+	}
+	if tenantID == "" || clientID == "" {
+		return "", "", terminalErrorf("a tenantID and clientID are required for the acr provider")
+	}
+
+	authorityHost := os.Getenv("AZURE_AUTHORITY_HOST")
+	if authorityHost == "" {
+		authorityHost = acrDefaultAuthorityHost
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", clientID)
+	form.Set("scope", acrScope)
+
+	if ref := provider.CredentialsRef; ref != nil {
+		secret := &corev1.Secret{}
+		if err := s.Get(ctx, client.ObjectKey{Name: ref.Name, Namespace: ref.Namespace}, secret); err != nil {
+			return "", "", errors.Wrapf(err, "unable to fetch credentialsRef %s.%s", ref.Name, ref.Namespace)
+		}
+
+		clientSecret := string(secret.Data[acrClientSecretKey])
+		if clientSecret == "" {
+			return "", "", fmt.Errorf("credentialsRef %s.%s has no %s key", ref.Name, ref.Namespace, acrClientSecretKey)
+		}
+		form.Set("client_secret", clientSecret)
+	} else {
+		tokenFile := os.Getenv("AZURE_FEDERATED_TOKEN_FILE")
+		if tokenFile == "" {
+			return "", "", terminalErrorf("a credentialsRef, or AZURE_FEDERATED_TOKEN_FILE on the controller is required for the acr provider")
+		}
+
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return "", "", errors.Wrap(err, "unable to read federated token")
+		}
+		form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		form.Set("client_assertion", strings.TrimSpace(string(token)))
+	}
+
+	tokenURL := fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimSuffix(authorityHost, "/"), tenantID)
+
+	res := azureTokenResponse{}
+	if err := postForm(ctx, tokenURL, form, &res); err != nil {
+		return "", "", errors.Wrap(err, "unable to fetch Azure AD token")
+	}
+
+	if res.AccessToken == "" {
+		return "", "", fmt.Errorf("no access_token returned by Azure AD")
+	}
+
+	return res.AccessToken, tenantID, nil
+}
+
+// acrRegistry returns true when registry is a host within one of
+// acrRegistryDomains, without a scheme, port or path
+func acrRegistry(registry string) bool {
+	if registry == "" || strings.ContainsAny(registry, ":/@?#") {
+		return false
+	}
+	for _, domain := range acrRegistryDomains {
+		if strings.HasSuffix(registry, domain) && len(registry) > len(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// postForm posts form to endpoint and decodes the JSON response into out
+func postForm(ctx context.Context, endpoint string, form url.Values, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d, body: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return json.Unmarshal(body, out)
+}
+
+// jwtExpiry reads the exp claim of a JWT without verifying its
+// signature, returning a zero time if it cannot be read
+func jwtExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+
+	claims := struct {
+		Exp int64 `json:"exp"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(claims.Exp, 0)
+}
@@ -3,13 +3,26 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"time"
 
 	ctrl "sigs.k8s.io/controller-runtime"
 
 	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	opsv1 "alexellis/registry-creds/api/v1"
 	v1 "alexellis/registry-creds/api/v1"
@@ -23,11 +36,19 @@ type ClusterPullSecretReconciler struct {
 	client.Client
 	Log              logr.Logger
 	Scheme           *runtime.Scheme
+	Recorder         record.EventRecorder
 	SecretReconciler *SecretReconciler
+
+	// CredentialProviderSecret holds the credentials of each
+	// ClusterPullSecret which sets spec.credentialProvider, for the
+	// kubelet credential provider plugin, when Name is empty no
+	// Secret is written
+	CredentialProviderSecret types.NamespacedName
 }
 
-// +kubebuilder:rbac:groups=ops.alexellis.io,resources=clusterpullsecrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups=ops.alexellis.io,resources=clusterpullsecrets,verbs=get;list;watch;update;patch
 // +kubebuilder:rbac:groups=ops.alexellis.io,resources=clusterpullsecrets/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=ops.alexellis.io,resources=clusterpullsecrets/finalizers,verbs=update
 
 // +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=secrets/status,verbs=get;update;patch
@@ -35,6 +56,8 @@ type ClusterPullSecretReconciler struct {
 // +kubebuilder:rbac:groups=core,resources=serviceaccounts,verbs=get;list;watch;update;patch
 // +kubebuilder:rbac:groups=core,resources=serviceaccounts/status,verbs=get;update;patch
 
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+
 // Reconcile applies a number of ClusterPullSecrets to the default ServiceAccount
 // within various valid namespaces. Namespaces can be ignored as required.
 func (r *ClusterPullSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -42,31 +65,319 @@ func (r *ClusterPullSecretReconciler) Reconcile(ctx context.Context, req ctrl.Re
 
 	var pullSecret v1.ClusterPullSecret
 	if err := r.Get(ctx, req.NamespacedName, &pullSecret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
 		r.Log.Info(fmt.Sprintf("unable to fetch pullSecret %s, error: %s", req.NamespacedName, err))
+		return reconcileResult(err)
+	}
+
+	if !pullSecret.DeletionTimestamp.IsZero() {
+		return reconcileResult(r.finalize(ctx, &pullSecret))
+	}
+
+	r.Log.Info(fmt.Sprintf("Found: %s\n", pullSecret.Name))
+
+	if controllerutil.AddFinalizer(&pullSecret, pullSecretFinalizer) {
+		if err := r.Update(ctx, &pullSecret); err != nil {
+			r.Log.Info(fmt.Sprintf("unable to add finalizer to pullSecret %s, error: %s", pullSecret.Name, err))
+			return reconcileResult(err)
+		}
+	}
+
+	status, errs := r.syncNamespaces(ctx, pullSecret)
+	if err := r.updateStatus(ctx, &pullSecret, status); err != nil {
+		r.Log.Info(fmt.Sprintf("unable to update status of pullSecret %s, error: %s", pullSecret.Name, err))
+		errs = append(errs, err)
+	}
+
+	if r.CredentialProviderSecret.Name != "" {
+		if err := r.publishCredentialProviderConfig(ctx, pullSecret); err != nil {
+			r.Log.Info(fmt.Sprintf("unable to update credential provider secret %s, error: %s", r.CredentialProviderSecret, err))
+			errs = append(errs, err)
+		}
+	}
+
+	result, err := reconcileResult(errs...)
+
+	// Terminal errors are already reported in the status, so expiring
+	// credentials are still refreshed for the namespaces which synced
+	if requeueAfter, ok := credentialsRequeueAfter(status, r.SecretReconciler.nextRefresh(pullSecret.UID)); ok && !result.Requeue &&
+		(err == nil || errors.Is(err, reconcile.TerminalError(nil))) {
+		return ctrl.Result{RequeueAfter: requeueAfter}, nil
+	}
+
+	return result, err
+}
+
+// credentialsRequeueAfter returns when to fetch new credentials, which is
+// shortly before the current credentials expire, or at refreshAt for
+// credentials which are read again on an interval, whichever is sooner.
+// Other credentials are only fetched again when the ClusterPullSecret or
+// its seed secrets change, or when fetching them failed and is being retried.
+func credentialsRequeueAfter(status v1.ClusterPullSecretStatus, refreshAt time.Time) (time.Duration, bool) {
+	next := refreshAt
+	if status.ExpiresAt != nil {
+		if expiresAt := refreshTime(status.ExpiresAt.Time); next.IsZero() || expiresAt.Before(next) {
+			next = expiresAt
+		}
+	}
+	if next.IsZero() {
+		return 0, false
+	}
+
+	requeueAfter := time.Until(next)
+	if requeueAfter < providerRetryInterval {
+		return providerRetryInterval, true
+	}
+	return requeueAfter, true
+}
+
+// syncNamespaces applies the pull secret to each namespace and returns
+// the observed status of the ClusterPullSecret, along with any errors so
+// that the caller can decide whether to retry.
+func (r *ClusterPullSecretReconciler) syncNamespaces(ctx context.Context, pullSecret v1.ClusterPullSecret) (v1.ClusterPullSecretStatus, []error) {
+	status := v1.ClusterPullSecretStatus{
+		ObservedGeneration: pullSecret.Generation,
+		Conditions:         append([]metav1.Condition{}, pullSecret.Status.Conditions...),
+	}
+
+	forgetStaleSeeds(pullSecret.Name, seedRefs(pullSecret))
+
+	_, expiry, err := r.SecretReconciler.getSeedSecret(pullSecret)
+	if err != nil {
+		r.Log.Info(err.Error())
+
+		var invalidSeed *invalidSeedError
+		var sourceErr *credentialSourceError
+		var filterErr *registryFilterError
+		if errors.As(err, &filterErr) {
+			r.Recorder.Event(&pullSecret, corev1.EventTypeWarning, filterErr.reason, err.Error())
+			setCondition(&status, v1.ConditionSeedSecretFound, metav1.ConditionTrue, "SeedSecretFound", "The seed secret was found")
+			setCondition(&status, v1.ConditionReady, metav1.ConditionFalse, filterErr.reason, err.Error())
+			setCondition(&status, v1.ConditionDegraded, metav1.ConditionTrue, filterErr.reason, err.Error())
+			setStalledCondition(&status, []error{err})
+			return status, []error{err}
+		} else if errors.As(err, &invalidSeed) {
+			r.Recorder.Event(&pullSecret, corev1.EventTypeWarning, "InvalidSeedSecret", err.Error())
+			setCondition(&status, v1.ConditionSeedSecretFound, metav1.ConditionTrue, "SeedSecretFound", "The seed secret was found")
+			setCondition(&status, v1.ConditionReady, metav1.ConditionFalse, "InvalidSeedSecret", err.Error())
+			setCondition(&status, v1.ConditionDegraded, metav1.ConditionTrue, "InvalidSeedSecret", err.Error())
+			setStalledCondition(&status, []error{err})
+			return status, []error{err}
+		} else if errors.As(err, &sourceErr) && sourceErr.source != secretRefSourceName {
+			r.Recorder.Event(&pullSecret, corev1.EventTypeWarning, "ProviderFailed", err.Error())
+			setCondition(&status, v1.ConditionSeedSecretFound, metav1.ConditionFalse, "ProviderFailed", err.Error())
+			setCondition(&status, v1.ConditionReady, metav1.ConditionFalse, "ProviderFailed", "Credentials could not be fetched from the provider")
+			setCondition(&status, v1.ConditionDegraded, metav1.ConditionTrue, "ProviderFailed", "Credentials could not be fetched from the provider")
+			setStalledCondition(&status, []error{err})
+			return status, []error{err}
+		}
+
+		r.Recorder.Event(&pullSecret, corev1.EventTypeWarning, "SeedMissing", err.Error())
+		setCondition(&status, v1.ConditionSeedSecretFound, metav1.ConditionFalse, "SeedSecretNotFound", err.Error())
+		setCondition(&status, v1.ConditionReady, metav1.ConditionFalse, "SeedSecretNotFound", "The seed secret could not be fetched")
+		setCondition(&status, v1.ConditionDegraded, metav1.ConditionTrue, "SeedSecretNotFound", "The seed secret could not be fetched")
+		setStalledCondition(&status, []error{err})
+		return status, []error{err}
+	}
+	setCondition(&status, v1.ConditionSeedSecretFound, metav1.ConditionTrue, "SeedSecretFound", "The seed secret was found")
+
+	if !expiry.IsZero() {
+		status.ExpiresAt = &metav1.Time{Time: expiry}
+		credentialsExpiry.WithLabelValues(pullSecret.Name).Set(float64(expiry.Unix()))
 	} else {
+		credentialsExpiry.DeleteLabelValues(pullSecret.Name)
+	}
 
-		r.Log.Info(fmt.Sprintf("Found: %s\n", pullSecret.Name))
+	namespaces := &corev1.NamespaceList{}
+	if err := r.Client.List(ctx, namespaces); err != nil {
+		r.Log.Info(fmt.Sprintf("unable to list namespaces, error: %s", err))
+		setCondition(&status, v1.ConditionReady, metav1.ConditionFalse, "ListNamespacesFailed", err.Error())
+		setStalledCondition(&status, []error{err})
+		return status, []error{err}
+	}
 
-		namespaces := &corev1.NamespaceList{}
-		r.Client.List(ctx, namespaces)
+	r.Log.V(10).Info(fmt.Sprintf("Found %d namespaces", len(namespaces.Items)))
 
-		r.Log.V(10).Info(fmt.Sprintf("Found %d namespaces", len(namespaces.Items)))
+	var errs []error
 
-		for _, namespace := range namespaces.Items {
-			namespaceName := namespace.Name
-			err := r.SecretReconciler.Reconcile(pullSecret, namespaceName)
-			if err != nil {
-				r.Log.Info(fmt.Sprintf("Found error: %s", err.Error()))
+	for _, namespace := range namespaces.Items {
+		// Copies cannot be created in a namespace which is being deleted
+		if terminatingNamespace(&namespace) {
+			status.IgnoredNamespaces++
+			continue
+		}
+
+		// Namespaces out of scope are still reconciled so that any
+		// previously provisioned copy can be withdrawn
+		inScope, err := r.SecretReconciler.namespaceInScope(pullSecret, &namespace)
+		if err == nil {
+			err = r.SecretReconciler.Reconcile(pullSecret, namespace.Name)
+		}
+		if err != nil {
+			r.Log.Info(fmt.Sprintf("Found error: %s", err.Error()))
+			errs = append(errs, err)
+			status.FailedNamespaces++
+			if len(status.Failures) < v1.MaxNamespaceFailures {
+				status.Failures = append(status.Failures, v1.NamespaceFailure{
+					Namespace: namespace.Name,
+					Reason:    err.Error(),
+				})
 			}
+			continue
 		}
 
+		if inScope {
+			status.SyncedNamespaces++
+		} else {
+			status.IgnoredNamespaces++
+		}
+	}
+
+	namespaceCoverage.WithLabelValues(pullSecret.Name, namespaceSynced).Set(float64(status.SyncedNamespaces))
+	namespaceCoverage.WithLabelValues(pullSecret.Name, namespaceFailed).Set(float64(status.FailedNamespaces))
+	namespaceCoverage.WithLabelValues(pullSecret.Name, namespaceIgnored).Set(float64(status.IgnoredNamespaces))
+
+	if status.FailedNamespaces > 0 {
+		message := fmt.Sprintf("%d namespace(s) failed to sync", status.FailedNamespaces)
+		r.Recorder.Event(&pullSecret, corev1.EventTypeWarning, "FanoutFailed", message)
+		setCondition(&status, v1.ConditionReady, metav1.ConditionFalse, "SyncFailed", message)
+		setCondition(&status, v1.ConditionDegraded, metav1.ConditionTrue, "SyncFailed", message)
+	} else {
+		message := fmt.Sprintf("Synced to %d namespace(s)", status.SyncedNamespaces)
+		// Only record the event when the ClusterPullSecret becomes Ready,
+		// or is synced to a different number of namespaces
+		if !meta.IsStatusConditionTrue(pullSecret.Status.Conditions, v1.ConditionReady) ||
+			pullSecret.Status.SyncedNamespaces != status.SyncedNamespaces {
+			r.Recorder.Event(&pullSecret, corev1.EventTypeNormal, "FanoutComplete", message)
+		}
+		setCondition(&status, v1.ConditionReady, metav1.ConditionTrue, "Synced", message)
+		setCondition(&status, v1.ConditionDegraded, metav1.ConditionFalse, "Synced", message)
+	}
+	setStalledCondition(&status, errs)
+
+	return status, errs
+}
+
+// setStalledCondition reports the first terminal error in errs, which
+// will not be retried, or clears the condition when there is none.
+func setStalledCondition(status *v1.ClusterPullSecretStatus, errs []error) {
+	for _, err := range errs {
+		if isTerminal(err) {
+			setCondition(status, v1.ConditionStalled, metav1.ConditionTrue, "TerminalError", err.Error())
+			return
+		}
+	}
+	setCondition(status, v1.ConditionStalled, metav1.ConditionFalse, "Progressing", "No errors which require a change to resolve")
+}
+
+// updateStatus writes status through the status subresource, skipping
+// the write when nothing has changed to avoid needless reconciliation.
+func (r *ClusterPullSecretReconciler) updateStatus(ctx context.Context, pullSecret *v1.ClusterPullSecret, status v1.ClusterPullSecretStatus) error {
+	if equality.Semantic.DeepEqual(pullSecret.Status, status) {
+		return nil
+	}
+
+	pullSecret.Status = status
+	return r.Status().Update(ctx, pullSecret)
+}
+
+func setCondition(status *v1.ClusterPullSecretStatus, conditionType string, conditionStatus metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		ObservedGeneration: status.ObservedGeneration,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// finalize removes the pull secret from the imagePullSecrets of the
+// ServiceAccounts in each namespace which holds a copy controlled by the
+// ClusterPullSecret, then releases the finalizer so that the
+// ClusterPullSecret and its namespaced copies can be garbage collected.
+func (r *ClusterPullSecretReconciler) finalize(ctx context.Context, pullSecret *v1.ClusterPullSecret) error {
+	if !controllerutil.ContainsFinalizer(pullSecret, pullSecretFinalizer) {
+		return nil
 	}
 
-	return ctrl.Result{}, nil
+	if err := r.SecretReconciler.release(*pullSecret); err != nil {
+		r.Log.Info(fmt.Sprintf("unable to remove pullSecret %s from service accounts, error: %s", pullSecret.Name, err))
+		return err
+	}
+
+	r.SecretReconciler.forgetCredentials(pullSecret.UID)
+	r.SecretReconciler.forgetIgnored(pullSecret.UID)
+	forgetMetrics(pullSecret.Name)
+
+	if r.CredentialProviderSecret.Name != "" {
+		if err := r.publishCredentialProviderConfig(ctx, *pullSecret); err != nil {
+			r.Log.Info(fmt.Sprintf("unable to update credential provider secret %s, error: %s", r.CredentialProviderSecret, err))
+			return err
+		}
+	}
+
+	controllerutil.RemoveFinalizer(pullSecret, pullSecretFinalizer)
+	if err := r.Update(ctx, pullSecret); err != nil {
+		r.Log.Info(fmt.Sprintf("unable to remove finalizer from pullSecret %s, error: %s", pullSecret.Name, err))
+		return err
+	}
+
+	r.Log.Info(fmt.Sprintf("Finalized: %s", pullSecret.Name))
+	return nil
+}
+
+// seedRefField indexes ClusterPullSecrets by the namespace/name of each
+// of their seed secrets
+const seedRefField = "spec.seedRefs"
+
+// pullSecretsForSeed maps a change to a seed Secret to each of the
+// ClusterPullSecrets which reference it, so that the new value can be
+// propagated to every namespace.
+func (r *ClusterPullSecretReconciler) pullSecretsForSeed(ctx context.Context, obj client.Object) []reconcile.Request {
+	pullSecretList := &v1.ClusterPullSecretList{}
+	if err := r.Client.List(ctx, pullSecretList,
+		client.MatchingFields{seedRefField: obj.GetNamespace() + "/" + obj.GetName()}); err != nil {
+		r.Log.Info(fmt.Sprintf("unable to list ClusterPullSecrets, %s", err.Error()))
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, pullSecret := range pullSecretList.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Name: pullSecret.Name},
+		})
+	}
+
+	return requests
+}
+
+// notControlledByPullSecret filters out the namespaced copies, which are
+// reconciled through Owns, from the watch of seed secrets
+func notControlledByPullSecret(obj client.Object) bool {
+	owner := metav1.GetControllerOf(obj)
+	return owner == nil || owner.Kind != "ClusterPullSecret" ||
+		owner.APIVersion != v1.GroupVersion.String()
 }
 
 func (r *ClusterPullSecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &v1.ClusterPullSecret{}, seedRefField, func(obj client.Object) []string {
+		var keys []string
+		for _, ref := range seedRefs(*obj.(*v1.ClusterPullSecret)) {
+			keys = append(keys, ref.Namespace+"/"+ref.Name)
+		}
+		return keys
+	}); err != nil {
+		return err
+	}
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&opsv1.ClusterPullSecret{}).
+		// Restore namespaced copies which are deleted or modified
+		Owns(&corev1.Secret{}).
+		// Propagate changes to seed secrets
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.pullSecretsForSeed),
+			builder.WithPredicates(predicate.NewPredicateFuncs(notControlledByPullSecret))).
 		Complete(r)
 }
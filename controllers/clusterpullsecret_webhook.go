@@ -0,0 +1,348 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "alexellis/registry-creds/api/v1"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// secretNameField indexes Secrets by name, so that copies
+// can be found in every namespace
+const secretNameField = "metadata.name"
+
+// maxClashingNamespaces limits how many namespaces are
+// listed when rejecting a ClusterPullSecret
+const maxClashingNamespaces = 5
+
+// +kubebuilder:webhook:path=/mutate-ops-alexellis-io-v1-clusterpullsecret,mutating=true,failurePolicy=fail,sideEffects=None,groups=ops.alexellis.io,resources=clusterpullsecrets,verbs=create;update,versions=v1,name=mclusterpullsecret.registry-creds.alexellis.io,admissionReviewVersions=v1
+// +kubebuilder:webhook:path=/validate-ops-alexellis-io-v1-clusterpullsecret,mutating=false,failurePolicy=fail,sideEffects=None,groups=ops.alexellis.io,resources=clusterpullsecrets,verbs=create;update,versions=v1,name=vclusterpullsecret.registry-creds.alexellis.io,admissionReviewVersions=v1
+
+// ClusterPullSecretWebhook defaults and validates ClusterPullSecrets, so
+// that mistakes are reported when they are applied rather than when the
+// pull secret is copied into each namespace.
+type ClusterPullSecretWebhook struct {
+	Client           client.Client
+	Log              logr.Logger
+	SecretReconciler *SecretReconciler
+}
+
+var _ admission.CustomDefaulter = &ClusterPullSecretWebhook{}
+var _ admission.CustomValidator = &ClusterPullSecretWebhook{}
+
+// SetupWebhookWithManager registers the defaulting and validating webhooks
+func (r *ClusterPullSecretWebhook) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Secret{}, secretNameField, func(obj client.Object) []string {
+		return []string{obj.GetName()}
+	}); err != nil {
+		return err
+	}
+
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&v1.ClusterPullSecret{}).
+		WithDefaulter(r).
+		WithValidator(r).
+		Complete()
+}
+
+// Default fills in the defaults of the providers and sources, so that
+// they are visible with kubectl get, and removes any secretRefs which
+// repeat an earlier seed.
+func (r *ClusterPullSecretWebhook) Default(ctx context.Context, obj runtime.Object) error {
+	pullSecret, ok := obj.(*v1.ClusterPullSecret)
+	if !ok {
+		return fmt.Errorf("expected a ClusterPullSecret but got %T", obj)
+	}
+	spec := &pullSecret.Spec
+
+	seen := map[v1.ObjectMeta]bool{}
+	if spec.SecretRef != nil {
+		seen[*spec.SecretRef] = true
+	}
+	var secretRefs []v1.ObjectMeta
+	for _, ref := range spec.SecretRefs {
+		if !seen[ref] {
+			seen[ref] = true
+			secretRefs = append(secretRefs, ref)
+		}
+	}
+	spec.SecretRefs = secretRefs
+
+	if spec.Provider != nil && spec.Provider.GCP != nil && spec.Provider.GCP.CredentialsKey == "" {
+		spec.Provider.GCP.CredentialsKey = gcpDefaultCredentialsKey
+	}
+
+	if spec.Source != nil && spec.Source.Vault != nil {
+		vault := spec.Source.Vault
+		if vault.Mount == "" {
+			vault.Mount = vaultDefaultMount
+		}
+		if vault.Auth.Kubernetes != nil && vault.Auth.Kubernetes.Mount == "" {
+			vault.Auth.Kubernetes.Mount = vaultDefaultKubernetesMount
+		}
+		if vault.RefreshInterval == nil {
+			vault.RefreshInterval = &metav1.Duration{Duration: vaultDefaultRefreshInterval}
+		}
+	}
+
+	if spec.Source != nil && spec.Source.HTTP != nil {
+		source := spec.Source.HTTP
+		if source.Mapping == nil {
+			source.Mapping = &v1.HTTPMapping{}
+		}
+		if source.Mapping.Registry == "" {
+			source.Mapping.Registry = httpDefaultRegistryPath
+		}
+		if source.Mapping.Username == "" {
+			source.Mapping.Username = httpDefaultUsernamePath
+		}
+		if source.Mapping.Password == "" {
+			source.Mapping.Password = httpDefaultPasswordPath
+		}
+		if source.Mapping.ExpiresAt == "" {
+			source.Mapping.ExpiresAt = httpDefaultExpiresAtPath
+		}
+		if source.RefreshInterval == nil {
+			source.RefreshInterval = &metav1.Duration{Duration: httpDefaultRefreshInterval}
+		}
+	}
+
+	return nil
+}
+
+// ValidateCreate checks the seed secrets and that the pull secret
+// will not overwrite a Secret which is not managed by the controller.
+func (r *ClusterPullSecretWebhook) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	pullSecret, ok := obj.(*v1.ClusterPullSecret)
+	if !ok {
+		return nil, fmt.Errorf("expected a ClusterPullSecret but got %T", obj)
+	}
+
+	allErrs, err := r.validate(ctx, pullSecret)
+	if err != nil {
+		return nil, err
+	}
+	allErrs = append(allErrs, validateSpec(pullSecret.Spec)...)
+
+	return nil, invalidPullSecret(pullSecret, allErrs)
+}
+
+// ValidateUpdate applies the same checks as ValidateCreate when the spec
+// changes. Only problems with the spec itself are rejected, since missing
+// or invalid seed secrets and clashing Secrets depend on the state of the
+// cluster, and would otherwise block updates to labels, annotations and
+// finalizers, including those of the controller. They are returned as
+// warnings instead.
+func (r *ClusterPullSecretWebhook) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	oldPullSecret, ok := oldObj.(*v1.ClusterPullSecret)
+	if !ok {
+		return nil, fmt.Errorf("expected a ClusterPullSecret but got %T", oldObj)
+	}
+	pullSecret, ok := newObj.(*v1.ClusterPullSecret)
+	if !ok {
+		return nil, fmt.Errorf("expected a ClusterPullSecret but got %T", newObj)
+	}
+
+	if !pullSecret.DeletionTimestamp.IsZero() || equality.Semantic.DeepEqual(oldPullSecret.Spec, pullSecret.Spec) {
+		return nil, nil
+	}
+
+	var warnings admission.Warnings
+
+	allErrs, err := r.validate(ctx, pullSecret)
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("unable to check for clashing Secrets: %s", err))
+	}
+
+	specErrs := validateSpec(pullSecret.Spec)
+	for _, fieldErr := range allErrs {
+		if fieldErr.Type == field.ErrorTypeRequired {
+			specErrs = append(specErrs, fieldErr)
+			continue
+		}
+		warnings = append(warnings, fieldErr.Error())
+	}
+
+	return warnings, invalidPullSecret(pullSecret, specErrs)
+}
+
+// ValidateDelete allows every ClusterPullSecret to be deleted
+func (r *ClusterPullSecretWebhook) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// validate returns the problems found with the seed secrets, and any
+// Secrets which would clash with the copies of the pull secret
+func (r *ClusterPullSecretWebhook) validate(ctx context.Context, pullSecret *v1.ClusterPullSecret) (field.ErrorList, error) {
+	allErrs := r.validateSeeds(ctx, pullSecret)
+
+	clashes, err := r.clashingNamespaces(ctx, pullSecret)
+	if err != nil {
+		return allErrs, err
+	}
+	if len(clashes) > 0 {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("metadata", "name"), pullSecret.Name,
+			fmt.Sprintf("a Secret with this name which is not managed by registry-creds exists in: %s", strings.Join(clashes, ", "))))
+	}
+
+	return allErrs, nil
+}
+
+func invalidPullSecret(pullSecret *v1.ClusterPullSecret, allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+
+	return apierrors.NewInvalid(v1.GroupVersion.WithKind("ClusterPullSecret").GroupKind(), pullSecret.Name, allErrs)
+}
+
+// validateSpec returns the problems with the spec which
+// do not depend on the state of the cluster
+func validateSpec(spec v1.ClusterPullSecretSpec) field.ErrorList {
+	allErrs := validateRegistries(spec.Registries)
+
+	if spec.Source != nil && spec.Source.Vault != nil {
+		vault := spec.Source.Vault
+		if vault.Address != "" && vault.Auth.TokenSecretRef == nil && !vaultAddressAllowed(strings.TrimSuffix(vault.Address, "/")) {
+			allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "source", "vault", "address"),
+				fmt.Sprintf("the kubernetes auth method may only be used with %s or %s of the controller", vaultAddressEnv, vaultAllowedAddressesEnv)))
+		}
+	}
+
+	return allErrs
+}
+
+// validateRegistries checks that the patterns of the registry filter are valid globs
+func validateRegistries(filter *v1.RegistryFilter) field.ErrorList {
+	var allErrs field.ErrorList
+	if filter == nil {
+		return allErrs
+	}
+
+	registriesPath := field.NewPath("spec", "registries")
+	for i, pattern := range filter.Allow {
+		if err := validateRegistryPattern(pattern); err != nil {
+			allErrs = append(allErrs, field.Invalid(registriesPath.Child("allow").Index(i), pattern, err.Error()))
+		}
+	}
+	for i, pattern := range filter.Deny {
+		if err := validateRegistryPattern(pattern); err != nil {
+			allErrs = append(allErrs, field.Invalid(registriesPath.Child("deny").Index(i), pattern, err.Error()))
+		}
+	}
+
+	return allErrs
+}
+
+// validateSeeds checks that each seed secret exists, and
+// holds, or can be converted to, a valid .dockerconfigjson
+func (r *ClusterPullSecretWebhook) validateSeeds(ctx context.Context, pullSecret *v1.ClusterPullSecret) field.ErrorList {
+	var allErrs field.ErrorList
+
+	spec := pullSecret.Spec
+	if spec.SecretRef == nil && len(spec.SecretRefs) == 0 && spec.Provider == nil && spec.Source == nil {
+		return append(allErrs, field.Required(field.NewPath("spec", "secretRef"),
+			"a secretRef, secretRefs, provider or source is required"))
+	}
+
+	var paths []*field.Path
+	if spec.SecretRef != nil {
+		paths = append(paths, field.NewPath("spec", "secretRef"))
+	}
+	for i := range spec.SecretRefs {
+		paths = append(paths, field.NewPath("spec", "secretRefs").Index(i))
+	}
+
+	for i, ref := range seedRefs(*pullSecret) {
+		refPath := paths[i]
+		if ref.Name == "" {
+			allErrs = append(allErrs, field.Required(refPath.Child("name"), "the name of the seed secret is required"))
+		}
+		if ref.Namespace == "" {
+			allErrs = append(allErrs, field.Required(refPath.Child("namespace"), "the namespace of the seed secret is required"))
+		}
+		if ref.Name == "" || ref.Namespace == "" {
+			continue
+		}
+
+		seed := &corev1.Secret{}
+		if err := r.Client.Get(ctx, client.ObjectKey{Name: ref.Name, Namespace: ref.Namespace}, seed); err != nil {
+			if apierrors.IsNotFound(err) {
+				allErrs = append(allErrs, field.NotFound(refPath, fmt.Sprintf("%s.%s", ref.Name, ref.Namespace)))
+			} else {
+				allErrs = append(allErrs, field.InternalError(refPath, err))
+			}
+			continue
+		}
+
+		seed, err := convertSeedSecret(seed)
+		if err == nil {
+			err = validateSeedSecret(seed)
+		}
+		if err != nil {
+			allErrs = append(allErrs, field.Invalid(refPath, fmt.Sprintf("%s.%s", ref.Name, ref.Namespace), err.Error()))
+		}
+	}
+
+	return allErrs
+}
+
+// clashingNamespaces returns the namespaces in scope which hold a Secret
+// with the name of the pull secret that the controller does not manage
+func (r *ClusterPullSecretWebhook) clashingNamespaces(ctx context.Context, pullSecret *v1.ClusterPullSecret) ([]string, error) {
+	secrets := &corev1.SecretList{}
+	if err := r.Client.List(ctx, secrets, client.MatchingFields{secretNameField: pullSecret.Name + secretSuffix}); err != nil {
+		return nil, err
+	}
+
+	var clashes []string
+	for _, secret := range secrets.Items {
+		if managedPullSecret(&secret, pullSecret) {
+			continue
+		}
+
+		namespace := &corev1.Namespace{}
+		if err := r.Client.Get(ctx, client.ObjectKey{Name: secret.Namespace}, namespace); err != nil {
+			return nil, err
+		}
+
+		inScope, err := r.SecretReconciler.namespaceInScope(*pullSecret, namespace)
+		if err != nil {
+			return nil, err
+		}
+		if !inScope {
+			continue
+		}
+
+		if len(clashes) == maxClashingNamespaces {
+			clashes = append(clashes, "...")
+			break
+		}
+		clashes = append(clashes, secret.Namespace)
+	}
+
+	return clashes, nil
+}
+
+// managedPullSecret returns true when secret is controlled by a
+// ClusterPullSecret of the same name. A new ClusterPullSecret has no UID
+// yet, so the UID is only compared for existing objects.
+func managedPullSecret(secret *corev1.Secret, pullSecret *v1.ClusterPullSecret) bool {
+	ref := metav1.GetControllerOf(secret)
+	if ref == nil || ref.Kind != "ClusterPullSecret" || ref.Name != pullSecret.Name {
+		return false
+	}
+	return pullSecret.UID == "" || ref.UID == pullSecret.UID
+}
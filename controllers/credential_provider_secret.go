@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	v1 "alexellis/registry-creds/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// credentialProviderKey is the key of the CredentialProviderSecret
+// which holds the .dockerconfigjson of a ClusterPullSecret
+func credentialProviderKey(name string) string {
+	return name + ".json"
+}
+
+// publishCredentialProviderConfig stores the credentials of one
+// ClusterPullSecret under its own key of the CredentialProviderSecret,
+// which the credential provider DaemonSet merges into the file read by
+// the plugin on each node. The key is removed when the ClusterPullSecret
+// is being deleted or does not set spec.credentialProvider, and is left
+// as it is when the credentials cannot be fetched.
+func (r *ClusterPullSecretReconciler) publishCredentialProviderConfig(ctx context.Context, pullSecret v1.ClusterPullSecret) error {
+	key := credentialProviderKey(pullSecret.Name)
+
+	var data []byte
+	if pullSecret.Spec.CredentialProvider && pullSecret.DeletionTimestamp.IsZero() {
+		seed, _, err := r.SecretReconciler.getSeedSecret(pullSecret)
+		if err != nil {
+			r.Log.Info(fmt.Sprintf("leaving credential provider config of %s unchanged, error: %s", pullSecret.Name, err))
+			return nil
+		}
+		data = seed.Data[corev1.DockerConfigJsonKey]
+	}
+
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, r.CredentialProviderSecret, secret); err != nil {
+		if !apierrors.IsNotFound(err) || data == nil {
+			return client.IgnoreNotFound(err)
+		}
+
+		return r.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      r.CredentialProviderSecret.Name,
+				Namespace: r.CredentialProviderSecret.Namespace,
+			},
+			Data: map[string][]byte{
+				key: data,
+			},
+		})
+	}
+
+	current, found := secret.Data[key]
+	if data == nil {
+		if !found {
+			return nil
+		}
+		delete(secret.Data, key)
+	} else {
+		if found && bytes.Equal(current, data) {
+			return nil
+		}
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		secret.Data[key] = data
+	}
+
+	return r.Update(ctx, secret)
+}
@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	v1 "alexellis/registry-creds/api/v1"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// CredentialSource generates the .dockerconfigjson of a ClusterPullSecret,
+// and is selected by a field of its spec, i.e. secretRef or provider.ecr
+type CredentialSource interface {
+	// Name identifies the source in logs and status
+	Name() string
+
+	// Configured returns true when the ClusterPullSecret selects the source
+	Configured(clusterPullSecret v1.ClusterPullSecret) bool
+
+	// Credentials returns a .dockerconfigjson along with when it expires,
+	// or a zero time when the credentials do not expire
+	Credentials(ctx context.Context, clusterPullSecret v1.ClusterPullSecret) ([]byte, time.Time, error)
+}
+
+// RefreshingCredentialSource is implemented by CredentialSources whose
+// credentials do not expire, but which should be read again on an
+// interval, such as a secret of Vault which may be changed at any time
+type RefreshingCredentialSource interface {
+	CredentialSource
+
+	// RefreshInterval returns how often to read the credentials again
+	RefreshInterval(clusterPullSecret v1.ClusterPullSecret) time.Duration
+}
+
+// CredentialSourceFactory creates a CredentialSource which
+// reads from the Kubernetes API using c
+type CredentialSourceFactory func(c client.Client) CredentialSource
+
+// credentialSourceFactories lists the built-in sources in order of
+// precedence, for when a ClusterPullSecret selects more than one
+var credentialSourceFactories = []CredentialSourceFactory{
+	newECRSource,
+	newGCPSource,
+	newACRSource,
+	newVaultSource,
+	newHTTPSource,
+	newSecretRefSource,
+}
+
+// DefaultCredentialSources creates each of the built-in CredentialSources
+func DefaultCredentialSources(c client.Client) []CredentialSource {
+	sources := make([]CredentialSource, 0, len(credentialSourceFactories))
+	for _, factory := range credentialSourceFactories {
+		sources = append(sources, factory(c))
+	}
+	return sources
+}
+
+// credentialSourceError is returned when a CredentialSource fails
+type credentialSourceError struct {
+	source string
+	err    error
+}
+
+func (e *credentialSourceError) Error() string {
+	return e.err.Error()
+}
+
+func (e *credentialSourceError) Unwrap() error {
+	return e.err
+}
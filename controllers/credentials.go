@@ -0,0 +1,241 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	v1 "alexellis/registry-creds/api/v1"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// tokenRefreshMargin is how long before expiry the
+// credentials of a provider are refreshed
+const tokenRefreshMargin = 10 * time.Minute
+
+// minCacheDuration is the shortest time credentials which expire are
+// cached for, so that credentials with a lifetime shorter than
+// tokenRefreshMargin are not fetched again for every namespace
+const minCacheDuration = time.Minute
+
+// providerRetryInterval is the shortest time to wait before fetching
+// credentials which are about to expire again
+const providerRetryInterval = time.Minute
+
+// httpClient is used to call the APIs of credential providers
+var httpClient = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+// cacheKey identifies the credentials of one source of a ClusterPullSecret
+type cacheKey struct {
+	uid    types.UID
+	source string
+}
+
+// cachedCredentials holds credentials which expire or are refreshed on
+// an interval, so that each namespace does not need to fetch its own token
+type cachedCredentials struct {
+	generation int64
+	data       []byte
+	expiry     time.Time
+	refreshAt  time.Time
+}
+
+// getSeedSecret returns a secret holding the .dockerconfigjson of the
+// ClusterPullSecret. The credentials of each configured CredentialSource
+// are merged in order of precedence, then filtered by the registries of
+// the ClusterPullSecret when set. The expiry is the earliest expiry of
+// any of the credentials, or a zero time when none expire.
+func (r *SecretReconciler) getSeedSecret(clusterPullSecret v1.ClusterPullSecret) (*corev1.Secret, time.Time, error) {
+	sources := r.CredentialSources
+	if len(sources) == 0 {
+		sources = DefaultCredentialSources(r.Client)
+	}
+
+	var results [][]byte
+	var expiry time.Time
+
+	for _, source := range sources {
+		if !source.Configured(clusterPullSecret) {
+			continue
+		}
+
+		data, sourceExpiry, err := r.sourceCredentials(source, clusterPullSecret)
+		if err != nil {
+			seedFetchFailures.WithLabelValues(clusterPullSecret.Name, source.Name()).Inc()
+			return nil, time.Time{}, &credentialSourceError{source: source.Name(), err: err}
+		}
+
+		results = append(results, data)
+		if !sourceExpiry.IsZero() && (expiry.IsZero() || sourceExpiry.Before(expiry)) {
+			expiry = sourceExpiry
+		}
+	}
+
+	if len(results) == 0 {
+		return nil, time.Time{}, terminalErrorf("no valid secretRef found on ClusterPullSecret: %s.%s",
+			clusterPullSecret.Name,
+			clusterPullSecret.Namespace)
+	}
+
+	data := results[0]
+	if len(results) > 1 || clusterPullSecret.Spec.Registries != nil {
+		var configs []*dockerConfigJSON
+		for _, result := range results {
+			config := &dockerConfigJSON{}
+			if err := json.Unmarshal(result, config); err != nil {
+				return nil, time.Time{}, errors.Wrapf(err, "unable to parse credentials of ClusterPullSecret: %s", clusterPullSecret.Name)
+			}
+			configs = append(configs, config)
+		}
+
+		config := mergeDockerConfigs(configs)
+
+		if clusterPullSecret.Spec.Registries != nil {
+			var err error
+			config, err = filterRegistries(config, clusterPullSecret.Spec.Registries)
+			if err != nil {
+				return nil, time.Time{}, terminal(errors.Wrapf(err, "unable to filter registries of ClusterPullSecret: %s", clusterPullSecret.Name))
+			}
+		}
+
+		var err error
+		data, err = json.Marshal(config)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+
+	return &corev1.Secret{
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: data,
+		},
+		Type: corev1.SecretTypeDockerConfigJson,
+	}, expiry, nil
+}
+
+// sourceCredentials returns the credentials of a source, using the cache
+// for credentials which expire or are refreshed on an interval, until they
+// are about to expire, are due to be refreshed, or the ClusterPullSecret
+// has changed. The cache is not locked while fetching,
+// so that a slow provider does not hold up other ClusterPullSecrets, and
+// concurrent fetches of the same credentials are shared.
+func (r *SecretReconciler) sourceCredentials(source CredentialSource, clusterPullSecret v1.ClusterPullSecret) ([]byte, time.Time, error) {
+	ctx := context.Background()
+
+	key := cacheKey{uid: clusterPullSecret.UID, source: source.Name()}
+
+	r.cacheLock.Lock()
+	cached, ok := r.cache[key]
+	r.cacheLock.Unlock()
+
+	if ok && cached.generation == clusterPullSecret.Generation && time.Now().Before(cached.refreshAt) {
+		return cached.data, cached.expiry, nil
+	}
+
+	fetchKey := fmt.Sprintf("%s/%s/%d", key.uid, key.source, clusterPullSecret.Generation)
+	result, err, _ := r.fetches.Do(fetchKey, func() (interface{}, error) {
+		data, expiry, err := source.Credentials(ctx, clusterPullSecret)
+		if err != nil {
+			return nil, err
+		}
+
+		fetched := cachedCredentials{
+			generation: clusterPullSecret.Generation,
+			data:       data,
+			expiry:     expiry,
+		}
+		if !expiry.IsZero() {
+			fetched.refreshAt = cacheUntil(time.Now(), expiry)
+		} else if refreshing, ok := source.(RefreshingCredentialSource); ok {
+			if interval := refreshing.RefreshInterval(clusterPullSecret); interval > 0 {
+				fetched.refreshAt = time.Now().Add(interval)
+			}
+		}
+		if fetched.refreshAt.IsZero() {
+			return fetched, nil
+		}
+
+		r.cacheLock.Lock()
+		if r.cache == nil {
+			r.cache = map[cacheKey]cachedCredentials{}
+		}
+		r.cache[key] = fetched
+		r.cacheLock.Unlock()
+
+		if expiry.IsZero() {
+			r.Log.Info(fmt.Sprintf("fetched credentials from %s for ClusterPullSecret: %s, refresh: %s",
+				source.Name(), clusterPullSecret.Name, fetched.refreshAt.Format(time.RFC3339)))
+		} else {
+			r.Log.Info(fmt.Sprintf("fetched credentials from %s for ClusterPullSecret: %s, expires: %s",
+				source.Name(), clusterPullSecret.Name, expiry.Format(time.RFC3339)))
+		}
+
+		return fetched, nil
+	})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	fetched := result.(cachedCredentials)
+	return fetched.data, fetched.expiry, nil
+}
+
+// forgetCredentials drops any cached credentials of a ClusterPullSecret
+func (r *SecretReconciler) forgetCredentials(uid types.UID) {
+	r.cacheLock.Lock()
+	defer r.cacheLock.Unlock()
+
+	for key := range r.cache {
+		if key.uid == uid {
+			delete(r.cache, key)
+		}
+	}
+}
+
+// nextRefresh returns when the earliest of the cached credentials of a
+// ClusterPullSecret which do not expire, but are refreshed on an
+// interval, are due to be read again, or a zero time when there are none
+func (r *SecretReconciler) nextRefresh(uid types.UID) time.Time {
+	r.cacheLock.Lock()
+	defer r.cacheLock.Unlock()
+
+	var next time.Time
+	for key, cached := range r.cache {
+		if key.uid != uid || !cached.expiry.IsZero() {
+			continue
+		}
+		if next.IsZero() || cached.refreshAt.Before(next) {
+			next = cached.refreshAt
+		}
+	}
+	return next
+}
+
+// refreshTime returns when credentials expiring at expiry should be refreshed
+func refreshTime(expiry time.Time) time.Time {
+	return expiry.Add(-tokenRefreshMargin)
+}
+
+// cacheUntil returns when credentials fetched at now, which expire at
+// expiry, should be fetched again. That is tokenRefreshMargin before they
+// expire, but no sooner than minCacheDuration, or half of their remaining
+// lifetime when that is shorter.
+func cacheUntil(now, expiry time.Time) time.Time {
+	floor := minCacheDuration
+	if remaining := expiry.Sub(now) / 2; remaining < floor {
+		floor = remaining
+	}
+
+	refreshAt := refreshTime(expiry)
+	if earliest := now.Add(floor); refreshAt.Before(earliest) {
+		return earliest
+	}
+	return refreshAt
+}
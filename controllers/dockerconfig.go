@@ -0,0 +1,282 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	v1 "alexellis/registry-creds/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// dockerConfigJSON is the format of the .dockerconfigjson key
+// of a kubernetes.io/dockerconfigjson Secret
+type dockerConfigJSON struct {
+	Auths map[string]dockerConfigEntry `json:"auths"`
+}
+
+// dockerConfigEntry holds the credentials for a single registry
+type dockerConfigEntry struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	Email         string `json:"email,omitempty"`
+	Auth          string `json:"auth,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	RegistryToken string `json:"registrytoken,omitempty"`
+}
+
+// defaultRegistryServer is used for basic-auth seeds
+// which do not specify a server
+const defaultRegistryServer = "https://index.docker.io/v1/"
+
+// seedServerKey and seedEmailKey are optional keys of a basic-auth seed,
+// alongside the username and password keys
+const (
+	seedServerKey = "server"
+	seedEmailKey  = "email"
+)
+
+// convertSeedSecret converts a kubernetes.io/dockercfg seed, or a seed
+// holding username, password and server keys, into a
+// kubernetes.io/dockerconfigjson Secret. Other seeds are returned as-is.
+func convertSeedSecret(secret *corev1.Secret) (*corev1.Secret, error) {
+	var config *dockerConfigJSON
+
+	switch {
+	case secret.Type == corev1.SecretTypeDockercfg:
+		auths := map[string]dockerConfigEntry{}
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigKey], &auths); err != nil {
+			return nil, &invalidSeedError{secret: secret,
+				reason: fmt.Sprintf("unable to parse %s: %s", corev1.DockerConfigKey, err)}
+		}
+		config = &dockerConfigJSON{Auths: auths}
+
+	case isBasicAuthSeed(secret):
+		server := string(secret.Data[seedServerKey])
+		if server == "" {
+			server = defaultRegistryServer
+		}
+		config = &dockerConfigJSON{
+			Auths: map[string]dockerConfigEntry{
+				server: {
+					Username: string(secret.Data[corev1.BasicAuthUsernameKey]),
+					Password: string(secret.Data[corev1.BasicAuthPasswordKey]),
+					Email:    string(secret.Data[seedEmailKey]),
+				},
+			},
+		}
+
+	default:
+		return secret, nil
+	}
+
+	for registry, entry := range config.Auths {
+		if entry.Auth == "" && entry.Username != "" && entry.Password != "" {
+			entry.Auth = base64.StdEncoding.EncodeToString([]byte(entry.Username + ":" + entry.Password))
+			config.Auths[registry] = entry
+		}
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	converted := secret.DeepCopy()
+	converted.Type = corev1.SecretTypeDockerConfigJson
+	converted.Data = map[string][]byte{
+		corev1.DockerConfigJsonKey: data,
+	}
+	return converted, nil
+}
+
+// isBasicAuthSeed returns true for kubernetes.io/basic-auth Secrets, and
+// Opaque Secrets holding a username and password.
+func isBasicAuthSeed(secret *corev1.Secret) bool {
+	if secret.Type == corev1.SecretTypeBasicAuth {
+		return true
+	}
+
+	_, hasUsername := secret.Data[corev1.BasicAuthUsernameKey]
+	_, hasPassword := secret.Data[corev1.BasicAuthPasswordKey]
+	return (secret.Type == corev1.SecretTypeOpaque || secret.Type == "") && hasUsername && hasPassword
+}
+
+// invalidSeedError is returned when a seed secret cannot be
+// used as an image pull secret
+type invalidSeedError struct {
+	secret *corev1.Secret
+	reason string
+}
+
+func (e *invalidSeedError) Error() string {
+	return fmt.Sprintf("invalid seed secret %s.%s: %s", e.secret.Name, e.secret.Namespace, e.reason)
+}
+
+// validateSeedSecret checks that the seed is a kubernetes.io/dockerconfigjson
+// Secret with well-formed auths, each holding an auth field, or a
+// username and password.
+func validateSeedSecret(secret *corev1.Secret) error {
+	if secret.Type != corev1.SecretTypeDockerConfigJson {
+		return &invalidSeedError{secret: secret,
+			reason: fmt.Sprintf("type is %s, but should be %s", secret.Type, corev1.SecretTypeDockerConfigJson)}
+	}
+
+	config, err := parseDockerConfigJSON(secret)
+	if err != nil {
+		return &invalidSeedError{secret: secret, reason: err.Error()}
+	}
+
+	if len(config.Auths) == 0 {
+		return &invalidSeedError{secret: secret, reason: "no auths found"}
+	}
+
+	for registry, entry := range config.Auths {
+		if err := validateDockerConfigEntry(entry); err != nil {
+			return &invalidSeedError{secret: secret, reason: fmt.Sprintf("registry %s: %s", registry, err)}
+		}
+	}
+
+	return nil
+}
+
+func validateDockerConfigEntry(entry dockerConfigEntry) error {
+	if entry.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return fmt.Errorf("auth is not valid base64: %s", err)
+		}
+		if !strings.Contains(string(decoded), ":") {
+			return fmt.Errorf("auth should be in the form of base64(username:password)")
+		}
+		return nil
+	}
+
+	if entry.Username == "" || entry.Password == "" {
+		return fmt.Errorf("an auth field, or a username and password are required")
+	}
+
+	return nil
+}
+
+func parseDockerConfigJSON(secret *corev1.Secret) (*dockerConfigJSON, error) {
+	data, ok := secret.Data[corev1.DockerConfigJsonKey]
+	if !ok {
+		return nil, fmt.Errorf("secret %s.%s has no %s key",
+			secret.Name, secret.Namespace, corev1.DockerConfigJsonKey)
+	}
+
+	config := &dockerConfigJSON{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("unable to parse %s of secret %s.%s: %s",
+			corev1.DockerConfigJsonKey, secret.Name, secret.Namespace, err)
+	}
+
+	return config, nil
+}
+
+// mergeDockerConfigs merges the auths of each config into a single
+// config. When a registry is found in more than one config, the entry
+// from the earliest config is kept.
+func mergeDockerConfigs(configs []*dockerConfigJSON) *dockerConfigJSON {
+	merged := dockerConfigJSON{
+		Auths: map[string]dockerConfigEntry{},
+	}
+
+	for _, config := range configs {
+		for registry, entry := range config.Auths {
+			if _, ok := merged.Auths[registry]; !ok {
+				merged.Auths[registry] = entry
+			}
+		}
+	}
+
+	return &merged
+}
+
+// registryFilterError is returned when the registries of a ClusterPullSecret
+// cannot be applied to its credentials, and is reported with reason
+type registryFilterError struct {
+	reason  string
+	message string
+}
+
+func (e *registryFilterError) Error() string {
+	return e.message
+}
+
+// filterRegistries returns a config holding only the auths which are
+// allowed, and not denied by filter. A filter with an invalid pattern,
+// or which removes every registry, is returned as a registryFilterError.
+func filterRegistries(config *dockerConfigJSON, filter *v1.RegistryFilter) (*dockerConfigJSON, error) {
+	for _, pattern := range append(append([]string{}, filter.Allow...), filter.Deny...) {
+		if err := validateRegistryPattern(pattern); err != nil {
+			return nil, &registryFilterError{reason: "InvalidRegistries", message: err.Error()}
+		}
+	}
+
+	filtered := &dockerConfigJSON{
+		Auths: map[string]dockerConfigEntry{},
+	}
+
+	for registry, entry := range config.Auths {
+		host := registryHost(registry)
+
+		if matchesRegistry(host, filter.Deny) {
+			continue
+		}
+
+		if len(filter.Allow) == 0 || matchesRegistry(host, filter.Allow) {
+			filtered.Auths[registry] = entry
+		}
+	}
+
+	if len(filtered.Auths) == 0 {
+		registries := make([]string, 0, len(config.Auths))
+		for registry := range config.Auths {
+			registries = append(registries, registry)
+		}
+		sort.Strings(registries)
+
+		return nil, &registryFilterError{reason: "NoRegistriesMatched",
+			message: fmt.Sprintf("spec.registries does not match any of the registries of the credentials: [%s]", strings.Join(registries, ", "))}
+	}
+
+	return filtered, nil
+}
+
+// validateRegistryPattern checks that pattern is a valid glob
+func validateRegistryPattern(pattern string) error {
+	if _, err := path.Match(strings.ToLower(registryHost(pattern)), ""); err != nil {
+		return fmt.Errorf("invalid registry pattern %q: %s", pattern, err)
+	}
+	return nil
+}
+
+// matchesRegistry returns true when host matches any of patterns,
+// which must have been checked with validateRegistryPattern
+func matchesRegistry(host string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.ToLower(registryHost(pattern)), host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// registryHost returns the host of an auths key, which may be a URL
+// such as https://index.docker.io/v1/
+func registryHost(registry string) string {
+	host := registry
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	return strings.ToLower(host)
+}
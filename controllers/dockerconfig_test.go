@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	v1 "alexellis/registry-creds/api/v1"
+
+	"github.com/pkg/errors"
+)
+
+func Test_filterRegistries(t *testing.T) {
+	config := &dockerConfigJSON{
+		Auths: map[string]dockerConfigEntry{
+			"ghcr.io":                     {Username: "alex", Password: "ghcr-token"},
+			"https://index.docker.io/v1/": {Auth: "ZG9ja2VyOmh1Yi10b2tlbg=="},
+			"registry.example.com":        {Username: "team", Password: "team-token"},
+			"legacy.example.com":          {Username: "legacy", Password: "legacy-token"},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		filter     v1.RegistryFilter
+		want       []string
+		wantReason string
+	}{
+		{
+			name:   "allow and deny",
+			filter: v1.RegistryFilter{Allow: []string{"ghcr.io", "*.example.com"}, Deny: []string{"legacy.example.com"}},
+			want:   []string{"ghcr.io", "registry.example.com"},
+		},
+		{
+			name:   "deny only",
+			filter: v1.RegistryFilter{Deny: []string{"*.example.com"}},
+			want:   []string{"ghcr.io", "https://index.docker.io/v1/"},
+		},
+		{
+			name:   "pattern is matched by host",
+			filter: v1.RegistryFilter{Allow: []string{"https://INDEX.docker.io/v2/"}},
+			want:   []string{"https://index.docker.io/v1/"},
+		},
+		{
+			name:       "invalid pattern",
+			filter:     v1.RegistryFilter{Allow: []string{"ghcr.io"}, Deny: []string{"["}},
+			wantReason: "InvalidRegistries",
+		},
+		{
+			name:       "no registries matched",
+			filter:     v1.RegistryFilter{Allow: []string{"quay.io"}},
+			wantReason: "NoRegistriesMatched",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filtered, err := filterRegistries(config, &test.filter)
+
+			if test.wantReason != "" {
+				var filterErr *registryFilterError
+				if !errors.As(err, &filterErr) || filterErr.reason != test.wantReason {
+					t.Fatalf("want a registryFilterError with reason %s, got: %v", test.wantReason, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			var got []string
+			for registry := range filtered.Auths {
+				got = append(got, registry)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Errorf("want registries %v, got: %v", test.want, got)
+			}
+		})
+	}
+}
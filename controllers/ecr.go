@@ -0,0 +1,334 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "alexellis/registry-creds/api/v1"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Keys of the Secret referenced by ECRProvider.CredentialsRef
+const (
+	awsAccessKeyIDKey     = "aws_access_key_id"
+	awsSecretAccessKeyKey = "aws_secret_access_key"
+	awsSessionTokenKey    = "aws_session_token"
+)
+
+const ecrGetAuthorizationTokenTarget = "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken"
+
+// awsRegionPattern matches the name of an AWS region, i.e. eu-west-1,
+// so that the region cannot change the host of the ECR or STS API
+var awsRegionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+type ecrGetAuthorizationTokenInput struct {
+	RegistryIDs []string `json:"registryIds,omitempty"`
+}
+
+type ecrGetAuthorizationTokenOutput struct {
+	AuthorizationData []ecrAuthorizationData `json:"authorizationData"`
+}
+
+type ecrAuthorizationData struct {
+	AuthorizationToken string  `json:"authorizationToken"`
+	ExpiresAt          float64 `json:"expiresAt"`
+	ProxyEndpoint      string  `json:"proxyEndpoint"`
+}
+
+// ecrSource fetches credentials for Amazon Elastic Container Registry
+type ecrSource struct {
+	client.Client
+}
+
+func newECRSource(c client.Client) CredentialSource {
+	return &ecrSource{Client: c}
+}
+
+func (s *ecrSource) Name() string {
+	return "ecr"
+}
+
+func (s *ecrSource) Configured(clusterPullSecret v1.ClusterPullSecret) bool {
+	return clusterPullSecret.Spec.Provider != nil && clusterPullSecret.Spec.Provider.ECR != nil
+}
+
+// Credentials calls the GetAuthorizationToken API of ECR and returns
+// a config with an entry for each registry.
+func (s *ecrSource) Credentials(ctx context.Context, clusterPullSecret v1.ClusterPullSecret) ([]byte, time.Time, error) {
+	provider := clusterPullSecret.Spec.Provider.ECR
+	if provider.Region == "" {
+		return nil, time.Time{}, terminalErrorf("a region is required for the ecr provider")
+	}
+	if !awsRegionPattern.MatchString(provider.Region) {
+		return nil, time.Time{}, terminalErrorf("invalid region for the ecr provider: %s", provider.Region)
+	}
+
+	creds, err := s.awsCredentials(ctx, provider)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_ECR")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://api.ecr.%s.amazonaws.com/", provider.Region)
+	}
+
+	body, err := json.Marshal(ecrGetAuthorizationTokenInput{RegistryIDs: provider.RegistryIDs})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", ecrGetAuthorizationTokenTarget)
+	signAWSRequest(req, body, creds, provider.Region, "ecr", time.Now())
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "unable to call ECR GetAuthorizationToken")
+	}
+	defer res.Body.Close()
+
+	resBody, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("unexpected status code from ECR GetAuthorizationToken: %d, body: %s",
+			res.StatusCode, strings.TrimSpace(string(resBody)))
+	}
+
+	output := ecrGetAuthorizationTokenOutput{}
+	if err := json.Unmarshal(resBody, &output); err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "unable to parse ECR GetAuthorizationToken response")
+	}
+
+	if len(output.AuthorizationData) == 0 {
+		return nil, time.Time{}, fmt.Errorf("no authorizationData returned by ECR GetAuthorizationToken")
+	}
+
+	config := &dockerConfigJSON{
+		Auths: map[string]dockerConfigEntry{},
+	}
+	var expiry time.Time
+
+	for _, data := range output.AuthorizationData {
+		decoded, err := base64.StdEncoding.DecodeString(data.AuthorizationToken)
+		if err != nil {
+			return nil, time.Time{}, errors.Wrap(err, "unable to decode ECR authorizationToken")
+		}
+
+		username, password, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return nil, time.Time{}, fmt.Errorf("unexpected format of ECR authorizationToken")
+		}
+
+		config.Auths[registryHost(data.ProxyEndpoint)] = dockerConfigEntry{
+			Username: username,
+			Password: password,
+			Auth:     data.AuthorizationToken,
+		}
+
+		expiresAt := time.Unix(0, int64(data.ExpiresAt*float64(time.Second)))
+		if expiry.IsZero() || expiresAt.Before(expiry) {
+			expiry = expiresAt
+		}
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return data, expiry, nil
+}
+
+// awsCredentials reads the credentials referenced by the provider, or falls
+// back to the environment of the controller, then to a web identity token
+// as provided by IAM Roles for Service Accounts (IRSA).
+func (s *ecrSource) awsCredentials(ctx context.Context, provider *v1.ECRProvider) (awsCredentials, error) {
+	if ref := provider.CredentialsRef; ref != nil {
+		secret := &corev1.Secret{}
+		if err := s.Get(ctx, client.ObjectKey{Name: ref.Name, Namespace: ref.Namespace}, secret); err != nil {
+			return awsCredentials{}, errors.Wrapf(err, "unable to fetch credentialsRef %s.%s", ref.Name, ref.Namespace)
+		}
+
+		creds := awsCredentials{
+			AccessKeyID:     string(secret.Data[awsAccessKeyIDKey]),
+			SecretAccessKey: string(secret.Data[awsSecretAccessKeyKey]),
+			SessionToken:    string(secret.Data[awsSessionTokenKey]),
+		}
+		if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+			return awsCredentials{}, fmt.Errorf("credentialsRef %s.%s requires the keys %s and %s",
+				ref.Name, ref.Namespace, awsAccessKeyIDKey, awsSecretAccessKeyKey)
+		}
+		return creds, nil
+	}
+
+	if accessKeyID := os.Getenv("AWS_ACCESS_KEY_ID"); accessKeyID != "" {
+		return awsCredentials{
+			AccessKeyID:     accessKeyID,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	roleARN := os.Getenv("AWS_ROLE_ARN")
+	tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	if roleARN != "" && tokenFile != "" {
+		return assumeRoleWithWebIdentity(ctx, provider.Region, roleARN, tokenFile)
+	}
+
+	return awsCredentials{}, fmt.Errorf("no AWS credentials found, set a credentialsRef or configure IRSA for the controller")
+}
+
+type assumeRoleWithWebIdentityResponse struct {
+	Credentials struct {
+		AccessKeyID     string `xml:"AccessKeyId"`
+		SecretAccessKey string `xml:"SecretAccessKey"`
+		SessionToken    string `xml:"SessionToken"`
+	} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+}
+
+// assumeRoleWithWebIdentity exchanges the projected ServiceAccount token
+// of the controller for temporary credentials using AWS STS.
+func assumeRoleWithWebIdentity(ctx context.Context, region, roleARN, tokenFile string) (awsCredentials, error) {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return awsCredentials{}, errors.Wrap(err, "unable to read web identity token")
+	}
+
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_STS")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://sts.%s.amazonaws.com/", region)
+	}
+
+	form := url.Values{}
+	form.Set("Action", "AssumeRoleWithWebIdentity")
+	form.Set("Version", "2011-06-15")
+	form.Set("RoleArn", roleARN)
+	form.Set("RoleSessionName", "registry-creds")
+	form.Set("WebIdentityToken", strings.TrimSpace(string(token)))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return awsCredentials{}, errors.Wrap(err, "unable to call STS AssumeRoleWithWebIdentity")
+	}
+	defer res.Body.Close()
+
+	resBody, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return awsCredentials{}, fmt.Errorf("unexpected status code from STS AssumeRoleWithWebIdentity: %d, body: %s",
+			res.StatusCode, strings.TrimSpace(string(resBody)))
+	}
+
+	output := assumeRoleWithWebIdentityResponse{}
+	if err := xml.Unmarshal(resBody, &output); err != nil {
+		return awsCredentials{}, errors.Wrap(err, "unable to parse STS AssumeRoleWithWebIdentity response")
+	}
+
+	return awsCredentials{
+		AccessKeyID:     output.Credentials.AccessKeyID,
+		SecretAccessKey: output.Credentials.SecretAccessKey,
+		SessionToken:    output.Credentials.SessionToken,
+	}, nil
+}
+
+// signAWSRequest signs req using AWS Signature Version 4
+func signAWSRequest(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{
+		"host": req.URL.Host,
+	}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := strings.Builder{}
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,239 @@
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "alexellis/registry-creds/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// Test_signAWSRequest_GetVanilla uses the get-vanilla request of the
+// AWS Signature Version 4 test suite
+func Test_signAWSRequest_GetVanilla(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds := awsCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	signAWSRequest(req, nil, creds, "us-east-1", "service", now)
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, " +
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("want Authorization:\n%s\ngot:\n%s", want, got)
+	}
+	if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+		t.Errorf("want X-Amz-Date: 20150830T123600Z, got: %s", got)
+	}
+}
+
+func Test_signAWSRequest_SignsSessionToken(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPost, "https://api.ecr.eu-west-1.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds := awsCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "secret",
+		SessionToken:    "session",
+	}
+
+	signAWSRequest(req, []byte("{}"), creds, "eu-west-1", "ecr", time.Now())
+
+	if got := req.Header.Get("X-Amz-Security-Token"); got != "session" {
+		t.Errorf("want X-Amz-Security-Token: session, got: %s", got)
+	}
+	if got := req.Header.Get("Authorization"); !strings.Contains(got, "SignedHeaders=host;x-amz-date;x-amz-security-token,") {
+		t.Errorf("want the session token to be signed, got Authorization: %s", got)
+	}
+}
+
+func Test_ecrSource_Credentials(t *testing.T) {
+	expiresAt := time.Now().Add(12 * time.Hour).Truncate(time.Second)
+
+	var gotTarget, gotAuthorization, gotSessionToken string
+	var gotInput ecrGetAuthorizationTokenInput
+	ecr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTarget = r.Header.Get("X-Amz-Target")
+		gotAuthorization = r.Header.Get("Authorization")
+		gotSessionToken = r.Header.Get("X-Amz-Security-Token")
+
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &gotInput); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fmt.Fprintf(w, `{"authorizationData":[{"authorizationToken":%q,"expiresAt":%d,"proxyEndpoint":"https://123456789012.dkr.ecr.eu-west-1.amazonaws.com"}]}`,
+			base64.StdEncoding.EncodeToString([]byte("AWS:password")), expiresAt.Unix())
+	}))
+	defer ecr.Close()
+
+	t.Setenv("AWS_ENDPOINT_URL_ECR", ecr.URL)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "aws", Namespace: "default"},
+		Data: map[string][]byte{
+			awsAccessKeyIDKey:     []byte("AKIDEXAMPLE"),
+			awsSecretAccessKeyKey: []byte("secret"),
+		},
+	}
+	source := &ecrSource{Client: fake.NewClientBuilder().WithObjects(secret).Build()}
+
+	data, expiry, err := source.Credentials(context.Background(), v1.ClusterPullSecret{
+		Spec: v1.ClusterPullSecretSpec{
+			Provider: &v1.Provider{
+				ECR: &v1.ECRProvider{
+					Region:         "eu-west-1",
+					RegistryIDs:    []string{"123456789012"},
+					CredentialsRef: &v1.ObjectMeta{Name: "aws", Namespace: "default"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if gotTarget != ecrGetAuthorizationTokenTarget {
+		t.Errorf("want X-Amz-Target: %s, got: %s", ecrGetAuthorizationTokenTarget, gotTarget)
+	}
+	if !strings.HasPrefix(gotAuthorization, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") ||
+		!strings.Contains(gotAuthorization, "/eu-west-1/ecr/aws4_request") {
+		t.Errorf("unexpected Authorization: %s", gotAuthorization)
+	}
+	if gotSessionToken != "" {
+		t.Errorf("want no session token, got: %s", gotSessionToken)
+	}
+	if len(gotInput.RegistryIDs) != 1 || gotInput.RegistryIDs[0] != "123456789012" {
+		t.Errorf("want registryIds [123456789012], got: %v", gotInput.RegistryIDs)
+	}
+
+	if !expiry.Equal(expiresAt) {
+		t.Errorf("want expiry %s, got: %s", expiresAt, expiry)
+	}
+
+	config := dockerConfigJSON{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatal(err)
+	}
+	entry, ok := config.Auths["123456789012.dkr.ecr.eu-west-1.amazonaws.com"]
+	if !ok {
+		t.Fatalf("want an entry for the proxyEndpoint, got: %s", data)
+	}
+	if entry.Username != "AWS" || entry.Password != "password" {
+		t.Errorf("want AWS:password, got: %s:%s", entry.Username, entry.Password)
+	}
+}
+
+func Test_ecrSource_Credentials_WebIdentity(t *testing.T) {
+	var gotForm map[string]string
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		gotForm = map[string]string{}
+		for key := range r.PostForm {
+			gotForm[key] = r.PostForm.Get(key)
+		}
+
+		fmt.Fprint(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>ASIAEXAMPLE</AccessKeyId>
+      <SecretAccessKey>temporary</SecretAccessKey>
+      <SessionToken>session</SessionToken>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`)
+	}))
+	defer sts.Close()
+
+	var gotAuthorization, gotSessionToken string
+	ecr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuthorization = r.Header.Get("Authorization")
+		gotSessionToken = r.Header.Get("X-Amz-Security-Token")
+
+		fmt.Fprintf(w, `{"authorizationData":[{"authorizationToken":%q,"expiresAt":%d,"proxyEndpoint":"https://123456789012.dkr.ecr.eu-west-1.amazonaws.com"}]}`,
+			base64.StdEncoding.EncodeToString([]byte("AWS:password")), time.Now().Add(time.Hour).Unix())
+	}))
+	defer ecr.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("web-identity-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/registry-creds")
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile)
+	t.Setenv("AWS_ENDPOINT_URL_STS", sts.URL)
+	t.Setenv("AWS_ENDPOINT_URL_ECR", ecr.URL)
+
+	source := &ecrSource{Client: fake.NewClientBuilder().Build()}
+
+	_, _, err := source.Credentials(context.Background(), v1.ClusterPullSecret{
+		Spec: v1.ClusterPullSecretSpec{
+			Provider: &v1.Provider{
+				ECR: &v1.ECRProvider{Region: "eu-west-1"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if gotForm["Action"] != "AssumeRoleWithWebIdentity" ||
+		gotForm["RoleArn"] != "arn:aws:iam::123456789012:role/registry-creds" ||
+		gotForm["WebIdentityToken"] != "web-identity-token" {
+		t.Errorf("unexpected STS request: %v", gotForm)
+	}
+
+	if !strings.HasPrefix(gotAuthorization, "AWS4-HMAC-SHA256 Credential=ASIAEXAMPLE/") {
+		t.Errorf("want the request signed with the credentials from STS, got Authorization: %s", gotAuthorization)
+	}
+	if gotSessionToken != "session" {
+		t.Errorf("want X-Amz-Security-Token: session, got: %s", gotSessionToken)
+	}
+}
+
+func Test_ecrSource_Credentials_InvalidRegion(t *testing.T) {
+	source := &ecrSource{Client: fake.NewClientBuilder().Build()}
+
+	_, _, err := source.Credentials(context.Background(), v1.ClusterPullSecret{
+		Spec: v1.ClusterPullSecretSpec{
+			Provider: &v1.Provider{
+				ECR: &v1.ECRProvider{Region: "attacker.example.com/"},
+			},
+		},
+	})
+	if err == nil {
+		t.Fatal("want an error for an invalid region")
+	}
+	if !isTerminal(err) {
+		t.Errorf("want a terminal error, got: %s", err)
+	}
+}
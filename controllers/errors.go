@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// terminalError is returned when retrying cannot succeed until the
+// ClusterPullSecret or one of the objects it references is changed,
+// for instance when a required field is missing
+type terminalError struct {
+	err error
+}
+
+func (e *terminalError) Error() string {
+	return e.err.Error()
+}
+
+func (e *terminalError) Unwrap() error {
+	return e.err
+}
+
+// terminalErrorf formats an error which should not be retried
+func terminalErrorf(format string, args ...interface{}) error {
+	return &terminalError{err: fmt.Errorf(format, args...)}
+}
+
+// terminal marks err as an error which should not be retried
+func terminal(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &terminalError{err: err}
+}
+
+// isTerminal returns true when retrying cannot resolve err, such as an
+// invalid seed secret, a misconfigured source or an object rejected by
+// the API server. Any other error, including conflicts, timeouts and a
+// missing seed secret, is expected to resolve itself given time.
+func isTerminal(err error) bool {
+	var terminalErr *terminalError
+	var invalidSeed *invalidSeedError
+
+	return errors.As(err, &terminalErr) ||
+		errors.As(err, &invalidSeed) ||
+		apierrors.IsInvalid(err) ||
+		apierrors.IsBadRequest(err)
+}
+
+// reconcileResult returns the result of a reconciliation which hit errs.
+// Retryable errors are returned so that the request is retried with the
+// rate limited backoff of the workqueue, conflicts are requeued with the
+// same backoff but without being logged as failures, and terminal errors
+// are returned as a reconcile.TerminalError so that they are logged and
+// counted once without being retried.
+func reconcileResult(errs ...error) (ctrl.Result, error) {
+	var retryable, terminalErrs []error
+	conflict := false
+
+	for _, err := range errs {
+		switch {
+		case err == nil:
+		case apierrors.IsConflict(err):
+			conflict = true
+		case isTerminal(err):
+			terminalErrs = append(terminalErrs, err)
+		default:
+			retryable = append(retryable, err)
+		}
+	}
+
+	if len(retryable) > 0 {
+		return ctrl.Result{}, utilerrors.NewAggregate(retryable)
+	}
+	if conflict {
+		return ctrl.Result{Requeue: true}, nil
+	}
+	if len(terminalErrs) > 0 {
+		return ctrl.Result{}, reconcile.TerminalError(utilerrors.NewAggregate(terminalErrs))
+	}
+	return ctrl.Result{}, nil
+}
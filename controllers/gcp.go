@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	v1 "alexellis/registry-creds/api/v1"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jwt"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// gcpAccessTokenUsername is the username used by Google's
+// registries to accept an OAuth2 access token as a password
+const gcpAccessTokenUsername = "oauth2accesstoken"
+
+const gcpDefaultCredentialsKey = "key.json"
+
+const gcpDefaultTokenURL = "https://oauth2.googleapis.com/token"
+
+const gcpCloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// gcpServiceAccountKey holds the fields used from the JSON
+// key of a Google Cloud service account
+type gcpServiceAccountKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// gcpSource fetches credentials for Google Artifact Registry and Container Registry
+type gcpSource struct {
+	client.Client
+}
+
+func newGCPSource(c client.Client) CredentialSource {
+	return &gcpSource{Client: c}
+}
+
+func (s *gcpSource) Name() string {
+	return "gcp"
+}
+
+func (s *gcpSource) Configured(clusterPullSecret v1.ClusterPullSecret) bool {
+	return clusterPullSecret.Spec.Provider != nil && clusterPullSecret.Spec.Provider.GCP != nil
+}
+
+// Credentials exchanges the referenced service account key for an
+// access token and returns a config with an entry for each registry.
+func (s *gcpSource) Credentials(ctx context.Context, clusterPullSecret v1.ClusterPullSecret) ([]byte, time.Time, error) {
+	provider := clusterPullSecret.Spec.Provider.GCP
+	if len(provider.Registries) == 0 {
+		return nil, time.Time{}, terminalErrorf("at least one registry is required for the gcp provider")
+	}
+
+	ref := provider.CredentialsRef
+	if ref == nil || ref.Name == "" || ref.Namespace == "" {
+		return nil, time.Time{}, terminalErrorf("a credentialsRef is required for the gcp provider")
+	}
+
+	secret := &corev1.Secret{}
+	if err := s.Get(ctx, client.ObjectKey{Name: ref.Name, Namespace: ref.Namespace}, secret); err != nil {
+		return nil, time.Time{}, errors.Wrapf(err, "unable to fetch credentialsRef %s.%s", ref.Name, ref.Namespace)
+	}
+
+	credentialsKey := provider.CredentialsKey
+	if credentialsKey == "" {
+		credentialsKey = gcpDefaultCredentialsKey
+	}
+
+	data, ok := secret.Data[credentialsKey]
+	if !ok {
+		return nil, time.Time{}, fmt.Errorf("credentialsRef %s.%s has no %s key", ref.Name, ref.Namespace, credentialsKey)
+	}
+
+	key := gcpServiceAccountKey{}
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, time.Time{}, errors.Wrapf(err, "unable to parse service account key in %s.%s", ref.Name, ref.Namespace)
+	}
+	if key.Type != "service_account" || key.ClientEmail == "" || key.PrivateKey == "" {
+		return nil, time.Time{}, fmt.Errorf("credentialsRef %s.%s does not hold a service account key", ref.Name, ref.Namespace)
+	}
+
+	tokenURL := provider.TokenURL
+	if tokenURL == "" {
+		tokenURL = key.TokenURI
+	}
+	if tokenURL == "" {
+		tokenURL = gcpDefaultTokenURL
+	}
+
+	jwtConfig := &jwt.Config{
+		Email:        key.ClientEmail,
+		PrivateKey:   []byte(key.PrivateKey),
+		PrivateKeyID: key.PrivateKeyID,
+		Scopes:       []string{gcpCloudPlatformScope},
+		TokenURL:     tokenURL,
+	}
+
+	token, err := jwtConfig.TokenSource(context.WithValue(ctx, oauth2.HTTPClient, httpClient)).Token()
+	if err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "unable to exchange service account key for an access token")
+	}
+
+	config := &dockerConfigJSON{
+		Auths: map[string]dockerConfigEntry{},
+	}
+	for _, registry := range provider.Registries {
+		config.Auths[registry] = dockerConfigEntry{
+			Username: gcpAccessTokenUsername,
+			Password: token.AccessToken,
+			Auth:     base64.StdEncoding.EncodeToString([]byte(gcpAccessTokenUsername + ":" + token.AccessToken)),
+		}
+	}
+
+	dockerConfig, err := json.Marshal(config)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return dockerConfig, token.Expiry, nil
+}
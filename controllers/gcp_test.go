@@ -0,0 +1,216 @@
+package controllers
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "alexellis/registry-creds/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// gcpTestKey returns a service account key which uses tokenURI,
+// along with its public key to verify assertions
+func gcpTestKey(t *testing.T, tokenURI string) ([]byte, *rsa.PublicKey) {
+	t.Helper()
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := json.Marshal(gcpServiceAccountKey{
+		Type:         "service_account",
+		ClientEmail:  "puller@example.iam.gserviceaccount.com",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		PrivateKeyID: "key-id",
+		TokenURI:     tokenURI,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, &privateKey.PublicKey
+}
+
+// gcpTokenServer stands in for the OAuth2 token endpoint of Google, and
+// only issues a token for a JWT assertion signed by publicKey
+func gcpTokenServer(publicKey *rsa.PublicKey) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if grantType := r.PostForm.Get("grant_type"); grantType != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			http.Error(w, "unexpected grant_type: "+grantType, http.StatusBadRequest)
+			return
+		}
+
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		if len(parts) != 3 {
+			http.Error(w, "assertion is not a JWT", http.StatusBadRequest)
+			return
+		}
+
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], signature); err != nil {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		claims := struct {
+			Iss   string `json:"iss"`
+			Scope string `json:"scope"`
+			Aud   string `json:"aud"`
+		}{}
+		if err := json.Unmarshal(payload, &claims); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if claims.Iss != "puller@example.iam.gserviceaccount.com" || claims.Scope != gcpCloudPlatformScope {
+			http.Error(w, fmt.Sprintf("unexpected claims: %+v", claims), http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"ya29.access-token","token_type":"Bearer","expires_in":3600}`)
+	}))
+}
+
+func Test_gcpSource_Credentials(t *testing.T) {
+	key, publicKey := gcpTestKey(t, "")
+	server := gcpTokenServer(publicKey)
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		tokenURI string
+		tokenURL string
+	}{
+		{
+			name:     "token_uri of the key",
+			tokenURI: server.URL,
+		},
+		{
+			name:     "tokenURL of the provider",
+			tokenURI: "https://oauth2.invalid/token",
+			tokenURL: server.URL,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			serviceAccountKey := gcpServiceAccountKey{}
+			if err := json.Unmarshal(key, &serviceAccountKey); err != nil {
+				t.Fatal(err)
+			}
+			serviceAccountKey.TokenURI = test.tokenURI
+			data, err := json.Marshal(serviceAccountKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "gcp", Namespace: "default"},
+				Data: map[string][]byte{
+					gcpDefaultCredentialsKey: data,
+				},
+			}
+			source := &gcpSource{Client: fake.NewClientBuilder().WithObjects(secret).Build()}
+
+			before := time.Now()
+			credentials, expiry, err := source.Credentials(context.Background(), v1.ClusterPullSecret{
+				Spec: v1.ClusterPullSecretSpec{
+					Provider: &v1.Provider{
+						GCP: &v1.GCPProvider{
+							Registries:     []string{"gcr.io", "europe-docker.pkg.dev"},
+							CredentialsRef: &v1.ObjectMeta{Name: "gcp", Namespace: "default"},
+							TokenURL:       test.tokenURL,
+						},
+					},
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if expiry.Before(before.Add(50*time.Minute)) || expiry.After(time.Now().Add(time.Hour)) {
+				t.Errorf("want an expiry in about 1 hour, got: %s", expiry)
+			}
+
+			config := dockerConfigJSON{}
+			if err := json.Unmarshal(credentials, &config); err != nil {
+				t.Fatal(err)
+			}
+			for _, registry := range []string{"gcr.io", "europe-docker.pkg.dev"} {
+				entry := config.Auths[registry]
+				if entry.Username != gcpAccessTokenUsername || entry.Password != "ya29.access-token" {
+					t.Errorf("want %s:ya29.access-token for %s, got: %s:%s",
+						gcpAccessTokenUsername, registry, entry.Username, entry.Password)
+				}
+			}
+		})
+	}
+}
+
+func Test_gcpSource_Credentials_Rejected(t *testing.T) {
+	// The token endpoint only trusts a different key
+	_, otherPublicKey := gcpTestKey(t, "")
+	server := gcpTokenServer(otherPublicKey)
+	defer server.Close()
+
+	key, _ := gcpTestKey(t, server.URL)
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "gcp", Namespace: "default"},
+		Data: map[string][]byte{
+			gcpDefaultCredentialsKey: key,
+		},
+	}
+	source := &gcpSource{Client: fake.NewClientBuilder().WithObjects(secret).Build()}
+
+	_, _, err := source.Credentials(context.Background(), v1.ClusterPullSecret{
+		Spec: v1.ClusterPullSecretSpec{
+			Provider: &v1.Provider{
+				GCP: &v1.GCPProvider{
+					Registries:     []string{"gcr.io"},
+					CredentialsRef: &v1.ObjectMeta{Name: "gcp", Namespace: "default"},
+				},
+			},
+		},
+	})
+	if err == nil {
+		t.Fatal("want an error when the token exchange is rejected")
+	}
+	if isTerminal(err) {
+		t.Errorf("want a rejected exchange to be retried, got a terminal error: %s", err)
+	}
+}
@@ -0,0 +1,286 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "alexellis/registry-creds/api/v1"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/util/jsonpath"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// httpTokenKey is the key of the Secret referenced
+// by HTTPSource.BearerTokenSecretRef
+const httpTokenKey = "token"
+
+// httpDefaultRefreshInterval is how often an endpoint is polled
+// when its response has no expiry and no refreshInterval is set
+const httpDefaultRefreshInterval = 5 * time.Minute
+
+// httpClientCacheSize is the most clients kept for distinct CA bundles
+// before their idle connections are closed and they are created again
+const httpClientCacheSize = 32
+
+// httpClients holds a client for each CA bundle, keyed by its SHA-256, so
+// that connections are reused between polls of an endpoint
+var (
+	httpClients     = map[[sha256.Size]byte]*http.Client{}
+	httpClientsLock sync.Mutex
+)
+
+// Default JSONPath expressions of HTTPMapping
+const (
+	httpDefaultRegistryPath  = "{.registry}"
+	httpDefaultUsernamePath  = "{.username}"
+	httpDefaultPasswordPath  = "{.password}"
+	httpDefaultExpiresAtPath = "{.expiresAt}"
+)
+
+// httpSource polls a JSON endpoint for credentials
+type httpSource struct {
+	client.Client
+}
+
+func newHTTPSource(c client.Client) CredentialSource {
+	return &httpSource{Client: c}
+}
+
+func (s *httpSource) Name() string {
+	return "http"
+}
+
+func (s *httpSource) Configured(clusterPullSecret v1.ClusterPullSecret) bool {
+	return clusterPullSecret.Spec.Source != nil && clusterPullSecret.Spec.Source.HTTP != nil
+}
+
+// Credentials calls the endpoint and maps its response onto an entry
+// for a single registry, which expires when the response says so.
+func (s *httpSource) Credentials(ctx context.Context, clusterPullSecret v1.ClusterPullSecret) ([]byte, time.Time, error) {
+	source := clusterPullSecret.Spec.Source.HTTP
+	if source.URL == "" {
+		return nil, time.Time{}, terminalErrorf("a url is required for the http source")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source.URL, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	if ref := source.BearerTokenSecretRef; ref != nil {
+		secret := &corev1.Secret{}
+		if err := s.Get(ctx, client.ObjectKey{Name: ref.Name, Namespace: ref.Namespace}, secret); err != nil {
+			return nil, time.Time{}, errors.Wrapf(err, "unable to fetch bearerTokenSecretRef %s.%s", ref.Name, ref.Namespace)
+		}
+
+		token := strings.TrimSpace(string(secret.Data[httpTokenKey]))
+		if token == "" {
+			return nil, time.Time{}, fmt.Errorf("bearerTokenSecretRef %s.%s has no %s key", ref.Name, ref.Namespace, httpTokenKey)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	c, err := httpSourceClient(source.CABundle)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	res, err := c.Do(req)
+	if err != nil {
+		return nil, time.Time{}, errors.Wrapf(err, "unable to call %s", source.URL)
+	}
+	defer res.Body.Close()
+
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("unexpected status code from %s: %d, body: %s",
+			source.URL, res.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var response interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&response); err != nil {
+		return nil, time.Time{}, errors.Wrapf(err, "unable to parse response from %s", source.URL)
+	}
+
+	mapping := source.Mapping
+	if mapping == nil {
+		mapping = &v1.HTTPMapping{}
+	}
+
+	registry, err := jsonPathValue(response, mapping.Registry, httpDefaultRegistryPath)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	username, err := jsonPathValue(response, mapping.Username, httpDefaultUsernamePath)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	password, err := jsonPathValue(response, mapping.Password, httpDefaultPasswordPath)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if registry == "" || username == "" || password == "" {
+		return nil, time.Time{}, fmt.Errorf("response from %s requires a registry, username and password", source.URL)
+	}
+
+	expiresAt, err := jsonPathValue(response, mapping.ExpiresAt, httpDefaultExpiresAtPath)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var expiry time.Time
+	if expiresAt != "" {
+		expiry, err = parseExpiry(expiresAt)
+		if err != nil {
+			return nil, time.Time{}, errors.Wrapf(err, "unable to parse expiry from %s", source.URL)
+		}
+	}
+
+	config := &dockerConfigJSON{
+		Auths: map[string]dockerConfigEntry{
+			registry: {
+				Username: username,
+				Password: password,
+				Auth:     base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+			},
+		},
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return data, expiry, nil
+}
+
+// RefreshInterval returns how often the endpoint is polled, which
+// only applies when its response has no expiry
+func (s *httpSource) RefreshInterval(clusterPullSecret v1.ClusterPullSecret) time.Duration {
+	source := clusterPullSecret.Spec.Source.HTTP
+	if source.RefreshInterval != nil && source.RefreshInterval.Duration > 0 {
+		return source.RefreshInterval.Duration
+	}
+	return httpDefaultRefreshInterval
+}
+
+// httpSourceClient returns httpClient, or a client which trusts
+// caBundle when one is given
+func httpSourceClient(caBundle []byte) (*http.Client, error) {
+	if len(caBundle) == 0 {
+		return httpClient, nil
+	}
+
+	key := sha256.Sum256(caBundle)
+
+	httpClientsLock.Lock()
+	defer httpClientsLock.Unlock()
+
+	if c, ok := httpClients[key]; ok {
+		return c, nil
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBundle) {
+		return nil, terminalErrorf("no certificates found in caBundle")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if len(httpClients) >= httpClientCacheSize {
+		for k, c := range httpClients {
+			c.CloseIdleConnections()
+			delete(httpClients, k)
+		}
+	}
+
+	c := &http.Client{
+		Timeout:   httpClient.Timeout,
+		Transport: transport,
+	}
+	httpClients[key] = c
+
+	return c, nil
+}
+
+// jsonPathValue evaluates a JSONPath expression against data, returning
+// an empty string when the value is missing. Expressions may omit their
+// braces, i.e. .data.username
+func jsonPathValue(data interface{}, expression, defaultExpression string) (string, error) {
+	if expression == "" {
+		expression = defaultExpression
+	}
+	if !strings.HasPrefix(expression, "{") {
+		expression = "{" + expression + "}"
+	}
+
+	path := jsonpath.New("mapping").AllowMissingKeys(true)
+	if err := path.Parse(expression); err != nil {
+		return "", terminal(errors.Wrapf(err, "invalid JSONPath expression %s", expression))
+	}
+
+	buf := &bytes.Buffer{}
+	if err := path.Execute(buf, data); err != nil {
+		return "", errors.Wrapf(err, "unable to evaluate JSONPath expression %s", expression)
+	}
+
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// maxUnixSeconds is the largest Unix time in seconds accepted as an expiry,
+// in the year 5138. Larger values are taken to be in milliseconds, which
+// many APIs return, and would otherwise overflow time.Duration.
+const maxUnixSeconds = 1e11
+
+// maxUnixMilliseconds is the largest Unix time in milliseconds accepted
+// as an expiry, which is also in the year 5138
+const maxUnixMilliseconds = maxUnixSeconds * 1000
+
+// parseExpiry parses an RFC 3339 timestamp, or seconds or milliseconds
+// since the Unix epoch
+func parseExpiry(value string) (time.Time, error) {
+	if expiry, err := time.Parse(time.RFC3339, value); err == nil {
+		return expiry, nil
+	}
+
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expiry %q is neither an RFC 3339 timestamp nor a Unix time", value)
+	}
+
+	if seconds >= maxUnixSeconds {
+		seconds /= 1000
+		if seconds >= maxUnixSeconds {
+			return time.Time{}, fmt.Errorf("expiry %q is out of range, the Unix time must be below %.0f milliseconds", value, maxUnixMilliseconds)
+		}
+	}
+	// Also rejects NaN
+	if !(seconds >= 0) {
+		return time.Time{}, fmt.Errorf("expiry %q is out of range, the Unix time must not be negative", value)
+	}
+
+	whole, fraction := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(fraction*float64(time.Second))), nil
+}
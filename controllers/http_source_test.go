@@ -0,0 +1,192 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func Test_parseExpiry(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{
+			name:  "RFC 3339 timestamp",
+			value: "2025-10-09T08:53:20Z",
+			want:  time.Date(2025, 10, 9, 8, 53, 20, 0, time.UTC),
+		},
+		{
+			name:  "RFC 3339 timestamp with an offset",
+			value: "2025-10-09T10:53:20+02:00",
+			want:  time.Date(2025, 10, 9, 8, 53, 20, 0, time.UTC),
+		},
+		{
+			name:  "seconds",
+			value: "1760000000",
+			want:  time.Date(2025, 10, 9, 8, 53, 20, 0, time.UTC),
+		},
+		{
+			name:  "fractional seconds",
+			value: "1760000000.5",
+			want:  time.Date(2025, 10, 9, 8, 53, 20, 500000000, time.UTC),
+		},
+		{
+			name:  "seconds in exponent notation",
+			value: "1.76e+09",
+			want:  time.Date(2025, 10, 9, 8, 53, 20, 0, time.UTC),
+		},
+		{
+			name:  "milliseconds",
+			value: "1760000000000",
+			want:  time.Date(2025, 10, 9, 8, 53, 20, 0, time.UTC),
+		},
+		{
+			name:  "milliseconds with a fraction of a second",
+			value: "1760000000250",
+			want:  time.Date(2025, 10, 9, 8, 53, 20, 250000000, time.UTC),
+		},
+		{
+			name:    "out of range",
+			value:   "1760000000000000",
+			wantErr: true,
+		},
+		{
+			name:    "negative",
+			value:   "-1",
+			wantErr: true,
+		},
+		{
+			name:    "NaN",
+			value:   "NaN",
+			wantErr: true,
+		},
+		{
+			name:    "infinity",
+			value:   "+Inf",
+			wantErr: true,
+		},
+		{
+			name:    "neither a timestamp nor a Unix time",
+			value:   "tomorrow",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseExpiry(test.value)
+
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("want an error, got: %s", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("want %s, got: %s", test.want, got)
+			}
+		})
+	}
+}
+
+func Test_jsonPathValue(t *testing.T) {
+	// Numbers are decoded in the same way as the responses of an HTTP source
+	decoder := json.NewDecoder(bytes.NewReader([]byte(`{
+		"data": {"username": "alex", "password": "ghcr-token", "registry": "ghcr.io"},
+		"expires_at": 1760000000000,
+		"ttl": 3600.5,
+		"registries": ["ghcr.io", "quay.io"]
+	}`)))
+	decoder.UseNumber()
+	var data interface{}
+	if err := decoder.Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name              string
+		expression        string
+		defaultExpression string
+		want              string
+		wantErr           bool
+		wantTerminal      bool
+	}{
+		{
+			name:       "expression with braces",
+			expression: "{.data.username}",
+			want:       "alex",
+		},
+		{
+			name:       "braceless expression",
+			expression: ".data.password",
+			want:       "ghcr-token",
+		},
+		{
+			name:              "default expression",
+			defaultExpression: ".data.registry",
+			want:              "ghcr.io",
+		},
+		{
+			name:       "integer",
+			expression: ".expires_at",
+			want:       "1760000000000",
+		},
+		{
+			name:       "decimal",
+			expression: ".ttl",
+			want:       "3600.5",
+		},
+		{
+			name:       "array index",
+			expression: ".registries[1]",
+			want:       "quay.io",
+		},
+		{
+			name:       "missing key",
+			expression: ".data.email",
+			want:       "",
+		},
+		{
+			name:       "missing parent",
+			expression: ".token.expires_at",
+			want:       "",
+		},
+		{
+			name:         "invalid expression",
+			expression:   "{.data[",
+			wantErr:      true,
+			wantTerminal: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := jsonPathValue(data, test.expression, test.defaultExpression)
+
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("want an error, got: %q", got)
+				}
+				if isTerminal(err) != test.wantTerminal {
+					t.Errorf("want terminal: %t, got: %s", test.wantTerminal, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != test.want {
+				t.Errorf("want %q, got: %q", test.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	v1 "alexellis/registry-creds/api/v1"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const metricsNamespace = "registry_creds"
+
+// Label values of serviceAccountsPatched
+const (
+	operationAttach = "attach"
+	operationRemove = "remove"
+)
+
+// Label values of namespaceCoverage
+const (
+	namespaceSynced  = "synced"
+	namespaceFailed  = "failed"
+	namespaceIgnored = "ignored"
+)
+
+var (
+	secretsCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "secrets_created_total",
+		Help:      "Pull secrets created in a namespace.",
+	}, []string{"clusterpullsecret"})
+
+	secretsUpdated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "secrets_updated_total",
+		Help:      "Pull secrets updated with new credentials, or restored after an edit.",
+	}, []string{"clusterpullsecret"})
+
+	secretsDeleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "secrets_deleted_total",
+		Help:      "Pull secrets deleted from a namespace.",
+	}, []string{"clusterpullsecret"})
+
+	serviceAccountsPatched = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "serviceaccounts_patched_total",
+		Help:      "ServiceAccounts which had a pull secret attached or removed.",
+	}, []string{"clusterpullsecret", "operation"})
+
+	seedFetchFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "seed_fetch_failures_total",
+		Help:      "Failures to fetch credentials from a seed secret, provider or source.",
+	}, []string{"clusterpullsecret", "source"})
+
+	namespaceCoverage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "namespaces",
+		Help:      "Namespaces by state, as of the last sync of a ClusterPullSecret.",
+	}, []string{"clusterpullsecret", "state"})
+
+	seedLastModified = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "seed_last_modified_timestamp_seconds",
+		Help:      "When a seed secret was last modified, as a Unix timestamp.",
+	}, []string{"clusterpullsecret", "seed"})
+
+	credentialsExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "credentials_expiry_timestamp_seconds",
+		Help:      "When the credentials of a ClusterPullSecret expire, as a Unix timestamp.",
+	}, []string{"clusterpullsecret"})
+)
+
+// seedSeries records the seed label values of seedLastModified for each
+// ClusterPullSecret, so that the series of removed seeds can be deleted
+var (
+	seedSeries     = map[string]map[string]bool{}
+	seedSeriesLock sync.Mutex
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		secretsCreated,
+		secretsUpdated,
+		secretsDeleted,
+		serviceAccountsPatched,
+		seedFetchFailures,
+		namespaceCoverage,
+		seedLastModified,
+		credentialsExpiry,
+	)
+}
+
+// forgetMetrics removes the series of a deleted ClusterPullSecret
+func forgetMetrics(name string) {
+	labels := prometheus.Labels{"clusterpullsecret": name}
+
+	secretsCreated.DeletePartialMatch(labels)
+	secretsUpdated.DeletePartialMatch(labels)
+	secretsDeleted.DeletePartialMatch(labels)
+	serviceAccountsPatched.DeletePartialMatch(labels)
+	seedFetchFailures.DeletePartialMatch(labels)
+	namespaceCoverage.DeletePartialMatch(labels)
+	seedLastModified.DeletePartialMatch(labels)
+	credentialsExpiry.DeletePartialMatch(labels)
+
+	seedSeriesLock.Lock()
+	delete(seedSeries, name)
+	seedSeriesLock.Unlock()
+}
+
+// setSeedLastModified records when a seed secret of a ClusterPullSecret
+// was last modified
+func setSeedLastModified(name string, ref v1.ObjectMeta, modified time.Time) {
+	seed := ref.Namespace + "/" + ref.Name
+
+	seedSeriesLock.Lock()
+	defer seedSeriesLock.Unlock()
+
+	if seedSeries[name] == nil {
+		seedSeries[name] = map[string]bool{}
+	}
+	seedSeries[name][seed] = true
+	seedLastModified.WithLabelValues(name, seed).Set(float64(modified.Unix()))
+}
+
+// forgetStaleSeeds removes the seedLastModified series of seed secrets
+// which are no longer referenced by a ClusterPullSecret
+func forgetStaleSeeds(name string, refs []v1.ObjectMeta) {
+	current := map[string]bool{}
+	for _, ref := range refs {
+		current[ref.Namespace+"/"+ref.Name] = true
+	}
+
+	seedSeriesLock.Lock()
+	defer seedSeriesLock.Unlock()
+
+	for seed := range seedSeries[name] {
+		if !current[seed] {
+			seedLastModified.DeleteLabelValues(name, seed)
+			delete(seedSeries[name], seed)
+		}
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/go-logr/logr"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
@@ -23,6 +24,7 @@ type NamespaceWatcher struct {
 	client.Client
 	Log              logr.Logger
 	Scheme           *runtime.Scheme
+	Recorder         record.EventRecorder
 	SecretReconciler *SecretReconciler
 }
 
@@ -34,8 +36,11 @@ func (r *NamespaceWatcher) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 
 	var namespace corev1.Namespace
 	if err := r.Get(ctx, req.NamespacedName, &namespace); err != nil {
-		r.Log.Info(fmt.Sprintf("unable to fetch pullSecret %s, error: %s", req.NamespacedName, err))
-		return ctrl.Result{}, nil
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		r.Log.Info(fmt.Sprintf("unable to fetch namespace %s, error: %s", req.NamespacedName, err))
+		return reconcileResult(err)
 	}
 
 	r.Log.V(10).Info(fmt.Sprintf("detected a change in namespace: %s", namespace.Name))
@@ -44,9 +49,10 @@ func (r *NamespaceWatcher) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 	err := r.Client.List(ctx, pullSecretList)
 	if err != nil {
 		r.Log.Info(fmt.Sprintf("unable to list ClusterPullSecrets, %s", err.Error()))
-		return ctrl.Result{}, nil
+		return reconcileResult(err)
 	}
 
+	var errs []error
 	for _, pullSecret := range pullSecretList.Items {
 		err := r.SecretReconciler.Reconcile(pullSecret, namespace.Name)
 		if err != nil {
@@ -55,11 +61,14 @@ func (r *NamespaceWatcher) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 					namespace.Name,
 					pullSecret.Name,
 					err.Error()))
+				r.Recorder.Eventf(&namespace, corev1.EventTypeWarning, "SyncFailed",
+					"Unable to provision ClusterPullSecret %s: %s", pullSecret.Name, err)
 			}
+			errs = append(errs, err)
 		}
 	}
 
-	return ctrl.Result{}, nil
+	return reconcileResult(errs...)
 }
 
 func (r *NamespaceWatcher) SetupWithManager(mgr ctrl.Manager) error {
@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// PodWebhookPath is where the PodInjector is served
+const PodWebhookPath = "/mutate-v1-pod"
+
+// +kubebuilder:webhook:path=/mutate-v1-pod,mutating=true,failurePolicy=ignore,sideEffects=None,groups="",resources=pods,verbs=create,versions=v1,name=mpod.registry-creds.alexellis.io,admissionReviewVersions=v1
+
+// PodInjector adds pull secrets to the imagePullSecrets of new Pods,
+// for when a Pod is created before the ServiceAccount watcher has
+// updated its ServiceAccount.
+type PodInjector struct {
+	Client           client.Client
+	Log              logr.Logger
+	Decoder          *admission.Decoder
+	SecretReconciler *SecretReconciler
+}
+
+// Handle adds the pull secret of each ClusterPullSecret which is in scope
+// for the namespace and ServiceAccount of the Pod, when its Secret exists
+// and holds credentials for a registry of one of the Pod's images. Pods are
+// always admitted, and are left unchanged when an error occurs.
+func (r *PodInjector) Handle(ctx context.Context, req admission.Request) admission.Response {
+	pod := &corev1.Pod{}
+	if err := r.Decoder.Decode(req, pod); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	secretNames, err := r.pullSecretsFor(ctx, req.Namespace, pod)
+	if err != nil {
+		r.Log.Info(fmt.Sprintf("unable to inject pull secrets into pod in namespace %s, error: %s", req.Namespace, err))
+		return admission.Allowed(err.Error())
+	}
+
+	changed := false
+	for _, secretName := range secretNames {
+		if !podHasImagePullSecret(pod, secretName) {
+			pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, corev1.LocalObjectReference{
+				Name: secretName,
+			})
+			changed = true
+		}
+	}
+
+	if !changed {
+		return admission.Allowed("")
+	}
+
+	marshaled, err := json.Marshal(pod)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	r.Log.V(10).Info(fmt.Sprintf("injecting pull secrets %v into pod in namespace %s", secretNames, req.Namespace))
+
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
+
+// pullSecretsFor returns the names of the pull secrets to add to the Pod
+func (r *PodInjector) pullSecretsFor(ctx context.Context, ns string, pod *corev1.Pod) ([]string, error) {
+	namespace := &corev1.Namespace{}
+	if err := r.Client.Get(ctx, client.ObjectKey{Name: ns}, namespace); err != nil {
+		return nil, err
+	}
+	if terminatingNamespace(namespace) {
+		return nil, nil
+	}
+
+	serviceAccountName := pod.Spec.ServiceAccountName
+	if serviceAccountName == "" {
+		serviceAccountName = "default"
+	}
+
+	// The ServiceAccount may not exist yet, in which case
+	// it can still be selected by its name
+	sa := &corev1.ServiceAccount{}
+	if err := r.Client.Get(ctx, client.ObjectKey{Name: serviceAccountName, Namespace: ns}, sa); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+		sa.Name = serviceAccountName
+		sa.Namespace = ns
+	}
+
+	pullSecrets, err := r.SecretReconciler.pullSecretsInScope(ctx, namespace, sa)
+	if err != nil {
+		return nil, err
+	}
+
+	var secretNames []string
+	for _, pullSecret := range pullSecrets {
+		secretName := pullSecret.Name + secretSuffix
+
+		secret := &corev1.Secret{}
+		if err := r.Client.Get(ctx, client.ObjectKey{Name: secretName, Namespace: ns}, secret); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		config, err := parseDockerConfigJSON(secret)
+		if err != nil {
+			return nil, err
+		}
+
+		if podUsesRegistry(pod, config) {
+			secretNames = append(secretNames, secretName)
+		}
+	}
+
+	return secretNames, nil
+}
+
+// podUsesRegistry returns true when an image of the Pod
+// is pulled from one of the registries of config
+func podUsesRegistry(pod *corev1.Pod, config *dockerConfigJSON) bool {
+	var images []string
+	for _, container := range pod.Spec.InitContainers {
+		images = append(images, container.Image)
+	}
+	for _, container := range pod.Spec.Containers {
+		images = append(images, container.Image)
+	}
+
+	for _, image := range images {
+		host := canonicalRegistryHost(imageRegistryHost(image))
+		for registry := range config.Auths {
+			pattern := canonicalRegistryHost(registryHost(registry))
+			if matched, err := path.Match(pattern, host); err == nil && matched {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// imageRegistryHost returns the registry of an image, which is
+// docker.io for images such as nginx or library/nginx
+func imageRegistryHost(image string) string {
+	host, _, found := strings.Cut(image, "/")
+	if !found || (!strings.ContainsAny(host, ".:") && host != "localhost") {
+		return "docker.io"
+	}
+	return strings.ToLower(host)
+}
+
+// canonicalRegistryHost treats the hosts of the Docker Hub as one registry
+func canonicalRegistryHost(host string) string {
+	switch host {
+	case "docker.io", "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+	return host
+}
+
+func podHasImagePullSecret(pod *corev1.Pod, secretName string) bool {
+	for _, secret := range pod.Spec.ImagePullSecrets {
+		if secret.Name == secretName {
+			return true
+		}
+	}
+	return false
+}
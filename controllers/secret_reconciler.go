@@ -4,16 +4,22 @@ import (
 	v1 "alexellis/registry-creds/api/v1"
 	"context"
 	"fmt"
+	"reflect"
 	"strings"
+	"sync"
 
 	ctrl "sigs.k8s.io/controller-runtime"
 
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/singleflight"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -22,8 +28,24 @@ import (
 // has an ignore annotation
 type SecretReconciler struct {
 	client.Client
-	Log    logr.Logger
-	Scheme *runtime.Scheme
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// DefaultMode applies to ClusterPullSecrets which do not set
+	// spec.mode, when empty v1.ModeOptOut is used
+	DefaultMode v1.Mode
+
+	// CredentialSources generate the .dockerconfigjson of each
+	// ClusterPullSecret, when empty DefaultCredentialSources are used
+	CredentialSources []CredentialSource
+
+	cacheLock sync.Mutex
+	cache     map[cacheKey]cachedCredentials
+	fetches   singleflight.Group
+
+	ignoredLock sync.Mutex
+	ignored     map[ignoredKey]bool
 }
 
 // secretSuffix was: -registrycreds
@@ -31,15 +53,145 @@ const secretSuffix = ""
 
 const ignoreAnnotation = "alexellis.io/registry-creds.ignore"
 
+// includeAnnotation lists the ClusterPullSecrets, separated by commas,
+// which a namespace opts into when running in v1.ModeOptIn
+const includeAnnotation = "alexellis.io/registry-creds.include"
+
+// pullSecretFinalizer is held on each ClusterPullSecret until its
+// references have been removed from every ServiceAccount
+const pullSecretFinalizer = "alexellis.io/registry-creds.finalizer"
+
 func ignoredNamespace(ns *corev1.Namespace) bool {
 	return ns.Annotations[ignoreAnnotation] == "1" || strings.ToLower(ns.Annotations[ignoreAnnotation]) == "true"
 }
 
+// terminatingNamespace returns true when the namespace is being deleted,
+// in which case the API server rejects the creation of new objects, and
+// its copies and ServiceAccounts are removed along with it
+func terminatingNamespace(ns *corev1.Namespace) bool {
+	return !ns.DeletionTimestamp.IsZero() || ns.Status.Phase == corev1.NamespaceTerminating
+}
+
+func includedNamespace(clusterPullSecret v1.ClusterPullSecret, ns *corev1.Namespace) bool {
+	for _, name := range strings.Split(ns.Annotations[includeAnnotation], ",") {
+		if strings.TrimSpace(name) == clusterPullSecret.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// mode returns the mode of the ClusterPullSecret, falling back to the
+// default mode of the controller.
+func (r *SecretReconciler) mode(clusterPullSecret v1.ClusterPullSecret) v1.Mode {
+	if clusterPullSecret.Spec.Mode != "" {
+		return clusterPullSecret.Spec.Mode
+	}
+	if r.DefaultMode != "" {
+		return r.DefaultMode
+	}
+	return v1.ModeOptOut
+}
+
+// selectedNamespace returns true when the namespace has opted into the
+// ClusterPullSecret if required, and its labels match the namespaceSelector
+// of the ClusterPullSecret, or when no selector is set.
+func (r *SecretReconciler) selectedNamespace(clusterPullSecret v1.ClusterPullSecret, ns *corev1.Namespace) (bool, error) {
+	if r.mode(clusterPullSecret) == v1.ModeOptIn && !includedNamespace(clusterPullSecret, ns) {
+		return false, nil
+	}
+
+	if clusterPullSecret.Spec.NamespaceSelector == nil {
+		return true, nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(clusterPullSecret.Spec.NamespaceSelector)
+	if err != nil {
+		return false, terminal(errors.Wrapf(err, "invalid namespaceSelector on ClusterPullSecret: %s", clusterPullSecret.Name))
+	}
+
+	return selector.Matches(labels.Set(ns.Labels)), nil
+}
+
+// selectedServiceAccount returns true when the ServiceAccount is matched by
+// the serviceAccountSelector of the ClusterPullSecret, or when no selector is set.
+func selectedServiceAccount(clusterPullSecret v1.ClusterPullSecret, sa *corev1.ServiceAccount) (bool, error) {
+	saSelector := clusterPullSecret.Spec.ServiceAccountSelector
+	if saSelector == nil || (saSelector.LabelSelector == nil && len(saSelector.Names) == 0) {
+		return true, nil
+	}
+
+	for _, name := range saSelector.Names {
+		if name == sa.Name {
+			return true, nil
+		}
+	}
+
+	if saSelector.LabelSelector == nil {
+		return false, nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(saSelector.LabelSelector)
+	if err != nil {
+		return false, terminal(errors.Wrapf(err, "invalid serviceAccountSelector on ClusterPullSecret: %s", clusterPullSecret.Name))
+	}
+
+	return selector.Matches(labels.Set(sa.Labels)), nil
+}
+
+// namespaceInScope returns true when the pull secret should be
+// provisioned into the namespace.
+func (r *SecretReconciler) namespaceInScope(clusterPullSecret v1.ClusterPullSecret, ns *corev1.Namespace) (bool, error) {
+	if ignoredNamespace(ns) || terminatingNamespace(ns) {
+		return false, nil
+	}
+
+	return r.selectedNamespace(clusterPullSecret, ns)
+}
+
+// pullSecretsInScope returns the ClusterPullSecrets which should be
+// appended to the ServiceAccount, skipping any which are being deleted.
+func (r *SecretReconciler) pullSecretsInScope(ctx context.Context, ns *corev1.Namespace, sa *corev1.ServiceAccount) ([]v1.ClusterPullSecret, error) {
+	pullSecretList := &v1.ClusterPullSecretList{}
+	if err := r.Client.List(ctx, pullSecretList); err != nil {
+		return nil, err
+	}
+
+	var pullSecrets []v1.ClusterPullSecret
+	for _, pullSecret := range pullSecretList.Items {
+		if !pullSecret.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		inScope, err := r.namespaceInScope(pullSecret, ns)
+		if err != nil {
+			return nil, err
+		}
+		if !inScope {
+			continue
+		}
+
+		selected, err := selectedServiceAccount(pullSecret, sa)
+		if err != nil {
+			return nil, err
+		}
+		if selected {
+			pullSecrets = append(pullSecrets, pullSecret)
+		}
+	}
+
+	return pullSecrets, nil
+}
+
 // Reconcile applies a number of ClusterPullSecrets to ServiceAccounts within
 // various valid namespaces. Namespaces can be ignored as required.
 func (r *SecretReconciler) Reconcile(clusterPullSecret v1.ClusterPullSecret, ns string) error {
 	ctx := context.Background()
 
+	if !clusterPullSecret.DeletionTimestamp.IsZero() {
+		return nil
+	}
+
 	targetNS := &corev1.Namespace{}
 	if err := r.Get(ctx, client.ObjectKey{Name: ns}, targetNS); err != nil {
 		wrappedErr := errors.Wrapf(err, "unable to fetch namespace: %s", ns)
@@ -47,35 +199,49 @@ func (r *SecretReconciler) Reconcile(clusterPullSecret v1.ClusterPullSecret, ns
 		return wrappedErr
 	}
 
+	if terminatingNamespace(targetNS) {
+		r.Log.V(10).Info(fmt.Sprintf("skipping namespace %s which is being deleted", ns))
+		return nil
+	}
+
 	if ignoredNamespace(targetNS) {
-		r.Log.Info(fmt.Sprintf("ignoring namespace %s due to annotation: %s ", ns, ignoreAnnotation))
+		if r.setIgnored(clusterPullSecret.UID, ns, true) {
+			r.Log.Info(fmt.Sprintf("ignoring namespace %s due to annotation: %s ", ns, ignoreAnnotation))
+			r.Recorder.Eventf(targetNS, corev1.EventTypeNormal, "Ignored",
+				"Not provisioning ClusterPullSecret %s due to annotation %s", clusterPullSecret.Name, ignoreAnnotation)
+		}
 		return nil
 	}
+	r.setIgnored(clusterPullSecret.UID, ns, false)
+
+	selected, err := r.selectedNamespace(clusterPullSecret, targetNS)
+	if err != nil {
+		r.Log.Info(err.Error())
+		return err
+	}
+
+	if !selected {
+		r.Log.V(10).Info(fmt.Sprintf("namespace %s not selected by ClusterPullSecret: %s", ns, clusterPullSecret.Name))
+		return r.withdraw(clusterPullSecret, ns)
+	}
 
 	r.Log.V(10).Info(fmt.Sprintf("Getting SA for: %s", ns))
 
-	if clusterPullSecret.Spec.SecretRef == nil ||
-		clusterPullSecret.Spec.SecretRef.Name == "" ||
-		clusterPullSecret.Spec.SecretRef.Namespace == "" {
-		return fmt.Errorf("no valid secretRef found on ClusterPullSecret: %s.%s",
-			clusterPullSecret.Name,
-			clusterPullSecret.Namespace)
-	}
-
-	pullSecret := &corev1.Secret{}
-	if err := r.Get(ctx,
-		client.ObjectKey{
-			Name:      clusterPullSecret.Spec.SecretRef.Name,
-			Namespace: clusterPullSecret.Spec.SecretRef.Namespace},
-		pullSecret); err != nil {
-		wrappedErr := errors.Wrapf(err, "unable to fetch seedSecret %s.%s", clusterPullSecret.Spec.SecretRef.Name, clusterPullSecret.Spec.SecretRef.Namespace)
-		r.Log.Info(fmt.Sprintf("%s", wrappedErr.Error()))
-		return wrappedErr
+	pullSecret, _, err := r.getSeedSecret(clusterPullSecret)
+	if err != nil {
+		r.Log.Info(err.Error())
+		return err
 	}
 
-	err := r.createSecret(clusterPullSecret, pullSecret, ns)
+	err = r.createSecret(clusterPullSecret, pullSecret, targetNS)
 	if err != nil {
+		// The namespace started terminating after it was read
+		if apierrors.HasStatusCause(err, corev1.NamespaceTerminatingCause) {
+			return nil
+		}
 		r.Log.Info(err.Error())
+		r.Recorder.Eventf(targetNS, corev1.EventTypeWarning, "SecretCreateFailed",
+			"Unable to create pull secret of ClusterPullSecret %s: %s", clusterPullSecret.Name, err)
 		return err
 	}
 
@@ -86,17 +252,79 @@ func (r *SecretReconciler) Reconcile(clusterPullSecret v1.ClusterPullSecret, ns
 		return wrappedErr
 	}
 
+	secretKey := clusterPullSecret.Name + secretSuffix
+
 	for _, sa := range SAs.Items {
-		err = r.appendSecretToSA(clusterPullSecret, pullSecret, ns, sa.Name)
+		selected, err := selectedServiceAccount(clusterPullSecret, &sa)
 		if err != nil {
 			r.Log.Info(err.Error())
 			return err
 		}
+
+		if !selected {
+			removed, err := removeSecretFromSA(ctx, r.Client, sa, secretKey)
+			if err != nil {
+				r.Log.Info(err.Error())
+				return err
+			}
+			if removed {
+				r.Log.Info(fmt.Sprintf("removed pull secret %s from unselected service account: %s.%s", secretKey, sa.Name, ns))
+			}
+			continue
+		}
+
+		err = r.appendSecretToSA(clusterPullSecret, ns, sa.Name)
+		if err != nil {
+			if !apierrors.IsConflict(err) {
+				r.Log.Info(err.Error())
+			}
+			return err
+		}
 	}
 
 	return nil
 }
 
+// ignoredKey identifies a namespace which is ignored by a ClusterPullSecret
+type ignoredKey struct {
+	uid       types.UID
+	namespace string
+}
+
+// setIgnored records whether a namespace is ignored by a ClusterPullSecret,
+// and returns true when it was not already known to be, so that the
+// Ignored event is only recorded once rather than on every reconcile
+func (r *SecretReconciler) setIgnored(uid types.UID, ns string, ignored bool) bool {
+	r.ignoredLock.Lock()
+	defer r.ignoredLock.Unlock()
+
+	key := ignoredKey{uid: uid, namespace: ns}
+	if !ignored {
+		delete(r.ignored, key)
+		return false
+	}
+	if r.ignored[key] {
+		return false
+	}
+	if r.ignored == nil {
+		r.ignored = map[ignoredKey]bool{}
+	}
+	r.ignored[key] = true
+	return true
+}
+
+// forgetIgnored drops the ignored namespaces of a ClusterPullSecret
+func (r *SecretReconciler) forgetIgnored(uid types.UID) {
+	r.ignoredLock.Lock()
+	defer r.ignoredLock.Unlock()
+
+	for key := range r.ignored {
+		if key.uid == uid {
+			delete(r.ignored, key)
+		}
+	}
+}
+
 func (r *SecretReconciler) listWithin(ns string) (*corev1.ServiceAccountList, error) {
 	ctx := context.Background()
 	SAs := &corev1.ServiceAccountList{}
@@ -107,9 +335,11 @@ func (r *SecretReconciler) listWithin(ns string) (*corev1.ServiceAccountList, er
 	return SAs, nil
 }
 
-func (r *SecretReconciler) createSecret(clusterPullSecret v1.ClusterPullSecret, pullSecret *corev1.Secret, ns string) error {
+func (r *SecretReconciler) createSecret(clusterPullSecret v1.ClusterPullSecret, pullSecret *corev1.Secret, namespace *corev1.Namespace) error {
 	ctx := context.Background()
 
+	ns := namespace.Name
+
 	secretKey := clusterPullSecret.Name + secretSuffix
 
 	nsSecret := &corev1.Secret{}
@@ -120,32 +350,80 @@ func (r *SecretReconciler) createSecret(clusterPullSecret v1.ClusterPullSecret,
 			return errors.Wrap(err, "unexpected error checking for the namespaced pull secret")
 		}
 
-		nsSecret = &corev1.Secret{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      secretKey,
-				Namespace: ns,
-			},
-			Data: pullSecret.Data,
-			Type: corev1.SecretTypeDockerConfigJson,
-		}
+		return r.createNamespacedSecret(clusterPullSecret, pullSecret, namespace)
+	}
 
-		err = ctrl.SetControllerReference(&clusterPullSecret, nsSecret, r.Scheme)
-		if err != nil {
-			r.Log.Info(fmt.Sprintf("can't create owner reference: %s.%s, %s", secretKey, ns, err.Error()))
+	if !metav1.IsControlledBy(nsSecret, &clusterPullSecret) {
+		return terminalErrorf("secret %s.%s exists and is not managed by ClusterPullSecret: %s",
+			secretKey, ns, clusterPullSecret.Name)
+	}
+
+	// The type of a Secret is immutable, so a copy with the wrong
+	// type has to be deleted and created again
+	if nsSecret.Type != corev1.SecretTypeDockerConfigJson {
+		err = r.Client.Delete(ctx, nsSecret)
+		if err != nil && !apierrors.IsNotFound(err) {
+			r.Log.Info(fmt.Sprintf("can't delete secret: %s.%s, %s", secretKey, ns, err.Error()))
+			return err
 		}
+		r.Log.Info(fmt.Sprintf("deleted secret with type %s: %s.%s", nsSecret.Type, secretKey, ns))
+		secretsDeleted.WithLabelValues(clusterPullSecret.Name).Inc()
+
+		return r.createNamespacedSecret(clusterPullSecret, pullSecret, namespace)
+	}
 
-		err = r.Client.Create(ctx, nsSecret)
+	// Propagate changes to the seed secret, i.e. after a token rotation,
+	// and restore copies which have been edited
+	if !reflect.DeepEqual(nsSecret.Data, pullSecret.Data) {
+		nsSecret.Data = pullSecret.Data
+
+		err = r.Client.Update(ctx, nsSecret)
 		if err != nil {
-			r.Log.Info(fmt.Sprintf("can't create secret: %s.%s, %s", secretKey, ns, err.Error()))
+			r.Log.Info(fmt.Sprintf("can't update secret: %s.%s, %s", secretKey, ns, err.Error()))
 			return err
 		}
-		r.Log.Info(fmt.Sprintf("created secret: %s.%s", secretKey, ns))
+		r.Log.Info(fmt.Sprintf("updated secret: %s.%s", secretKey, ns))
+		secretsUpdated.WithLabelValues(clusterPullSecret.Name).Inc()
+	}
+
+	return nil
+}
+
+func (r *SecretReconciler) createNamespacedSecret(clusterPullSecret v1.ClusterPullSecret, pullSecret *corev1.Secret, namespace *corev1.Namespace) error {
+	ctx := context.Background()
+
+	ns := namespace.Name
+
+	secretKey := clusterPullSecret.Name + secretSuffix
+
+	nsSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretKey,
+			Namespace: ns,
+		},
+		Data: pullSecret.Data,
+		Type: corev1.SecretTypeDockerConfigJson,
 	}
 
+	err := ctrl.SetControllerReference(&clusterPullSecret, nsSecret, r.Scheme)
+	if err != nil {
+		r.Log.Info(fmt.Sprintf("can't create owner reference: %s.%s, %s", secretKey, ns, err.Error()))
+	}
+
+	err = r.Client.Create(ctx, nsSecret)
+	if err != nil {
+		r.Log.Info(fmt.Sprintf("can't create secret: %s.%s, %s", secretKey, ns, err.Error()))
+		return err
+	}
+	r.Log.Info(fmt.Sprintf("created secret: %s.%s", secretKey, ns))
+	secretsCreated.WithLabelValues(clusterPullSecret.Name).Inc()
+	r.Recorder.Eventf(namespace, corev1.EventTypeNormal, "SecretCreated",
+		"Created pull secret %s for ClusterPullSecret %s", secretKey, clusterPullSecret.Name)
+
 	return nil
 }
 
-func (r *SecretReconciler) appendSecretToSA(clusterPullSecret v1.ClusterPullSecret, pullSecret *corev1.Secret, ns, serviceAccountName string) error {
+func (r *SecretReconciler) appendSecretToSA(clusterPullSecret v1.ClusterPullSecret, ns, serviceAccountName string) error {
 	ctx := context.Background()
 
 	secretKey := clusterPullSecret.Name + secretSuffix
@@ -153,13 +431,8 @@ func (r *SecretReconciler) appendSecretToSA(clusterPullSecret v1.ClusterPullSecr
 	sa := &corev1.ServiceAccount{}
 	err := r.Client.Get(ctx, client.ObjectKey{Name: serviceAccountName, Namespace: ns}, sa)
 	if err != nil {
-		if !apierrors.IsConflict(err) {
-			r.Log.Info(fmt.Sprintf("error getting SA in namespace: %s, %s", ns, err.Error()))
-			wrappedErr := fmt.Errorf("unable to append pull secret to service account: %s", err)
-			r.Log.Info(wrappedErr.Error())
-			return wrappedErr
-		}
-		return err
+		r.Log.Info(fmt.Sprintf("error getting SA in namespace: %s, %s", ns, err.Error()))
+		return errors.Wrap(err, "unable to append pull secret to service account")
 	}
 
 	r.Log.V(10).Info(fmt.Sprintf("Pull secrets: %v", sa.ImagePullSecrets))
@@ -173,19 +446,158 @@ func (r *SecretReconciler) appendSecretToSA(clusterPullSecret v1.ClusterPullSecr
 
 		err = r.Update(ctx, sa.DeepCopy())
 		if err != nil {
+			// A conflict is returned so that the namespace is requeued
+			// with the latest version of the ServiceAccount
 			if !apierrors.IsConflict(err) {
-
-				wrappedErr := fmt.Errorf("unable to append pull secret to service account: %s", err)
-				r.Log.Info(wrappedErr.Error())
-				return err
+				r.Recorder.Eventf(sa, corev1.EventTypeWarning, "PullSecretAttachFailed",
+					"Unable to attach pull secret %s: %s", secretKey, err)
 			}
-			return nil
+			return errors.Wrap(err, "unable to append pull secret to service account")
+		}
+		r.Recorder.Eventf(sa, corev1.EventTypeNormal, "PullSecretAttached",
+			"Attached pull secret %s of ClusterPullSecret %s", secretKey, clusterPullSecret.Name)
+		serviceAccountsPatched.WithLabelValues(clusterPullSecret.Name, operationAttach).Inc()
+	}
+
+	return nil
+}
+
+// withdraw removes the pull secret from the ServiceAccounts of a namespace
+// which is no longer in scope, and deletes the namespaced copy.
+func (r *SecretReconciler) withdraw(clusterPullSecret v1.ClusterPullSecret, ns string) error {
+	ctx := context.Background()
+
+	secretKey := clusterPullSecret.Name + secretSuffix
+
+	// A Secret of the same name which the ClusterPullSecret does not
+	// control, and the ServiceAccounts which reference it, are left alone.
+	// When the copy has already been deleted, by hand or by a foreground
+	// cascading deletion, the references to it are still removed.
+	nsSecret := &corev1.Secret{}
+	err := r.Client.Get(ctx, client.ObjectKey{Name: secretKey, Namespace: ns}, nsSecret)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return r.removeSecretFromSAs(clusterPullSecret, ns)
 		}
+		return errors.Wrap(err, "unexpected error checking for the namespaced pull secret")
+	}
+
+	if !metav1.IsControlledBy(nsSecret, &clusterPullSecret) {
+		return nil
+	}
+
+	if err := r.removeSecretFromSAs(clusterPullSecret, ns); err != nil {
+		return err
+	}
+
+	err = r.Client.Delete(ctx, nsSecret)
+	if err != nil && !apierrors.IsNotFound(err) {
+		r.Log.Info(fmt.Sprintf("can't delete secret: %s.%s, %s", secretKey, ns, err.Error()))
+		return err
 	}
+	r.Log.Info(fmt.Sprintf("deleted secret: %s.%s", secretKey, ns))
+	secretsDeleted.WithLabelValues(clusterPullSecret.Name).Inc()
 
 	return nil
 }
 
+// release removes the pull secret from the ServiceAccounts of each
+// namespace which holds a copy controlled by the ClusterPullSecret, or
+// where the copy has already been deleted. A Secret of the same name
+// which belongs to something else, and the ServiceAccounts which
+// reference it, are left alone.
+func (r *SecretReconciler) release(clusterPullSecret v1.ClusterPullSecret) error {
+	ctx := context.Background()
+
+	secretKey := clusterPullSecret.Name + secretSuffix
+
+	namespaces := &corev1.NamespaceList{}
+	if err := r.Client.List(ctx, namespaces); err != nil {
+		return errors.Wrap(err, "failed to list namespaces")
+	}
+
+	for _, namespace := range namespaces.Items {
+		nsSecret := &corev1.Secret{}
+		err := r.Client.Get(ctx, client.ObjectKey{Name: secretKey, Namespace: namespace.Name}, nsSecret)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrap(err, "unexpected error checking for the namespaced pull secret")
+		}
+
+		if err == nil && !metav1.IsControlledBy(nsSecret, &clusterPullSecret) {
+			continue
+		}
+
+		if err := r.removeSecretFromSAs(clusterPullSecret, namespace.Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeSecretFromSAs removes the pull secret from the imagePullSecrets
+// of every ServiceAccount within ns.
+func (r *SecretReconciler) removeSecretFromSAs(clusterPullSecret v1.ClusterPullSecret, ns string) error {
+	ctx := context.Background()
+
+	secretKey := clusterPullSecret.Name + secretSuffix
+
+	SAs, err := r.listWithin(ns)
+	if err != nil {
+		return errors.Wrapf(err, "failed to list service accounts in %q namespace", ns)
+	}
+
+	for _, sa := range SAs.Items {
+		removed, err := removeSecretFromSA(ctx, r.Client, sa, secretKey)
+		if err != nil {
+			return err
+		}
+		if removed {
+			r.Log.Info(fmt.Sprintf("removed pull secret %s from service account: %s.%s", secretKey, sa.Name, sa.Namespace))
+		}
+	}
+
+	return nil
+}
+
+// removeSecretFromSA removes secretKey from the imagePullSecrets of sa and
+// saves it, returning true if sa was modified.
+func removeSecretFromSA(ctx context.Context, c client.Client, sa corev1.ServiceAccount, secretKey string) (bool, error) {
+	if !removeImagePullSecret(&sa, secretKey) {
+		return false, nil
+	}
+
+	err := c.Update(ctx, sa.DeepCopy())
+	if err != nil {
+		// A ServiceAccount which was deleted no longer references the secret
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "unable to remove pull secret from service account: %s.%s", sa.Name, sa.Namespace)
+	}
+	serviceAccountsPatched.WithLabelValues(strings.TrimSuffix(secretKey, secretSuffix), operationRemove).Inc()
+
+	return true, nil
+}
+
+// removeImagePullSecret removes secretKey from the imagePullSecrets of sa,
+// returning true if sa was modified.
+func removeImagePullSecret(sa *corev1.ServiceAccount, secretKey string) bool {
+	if !hasImagePullSecret(sa, secretKey) {
+		return false
+	}
+
+	pullSecrets := []corev1.LocalObjectReference{}
+	for _, s := range sa.ImagePullSecrets {
+		if s.Name != secretKey {
+			pullSecrets = append(pullSecrets, s)
+		}
+	}
+	sa.ImagePullSecrets = pullSecrets
+
+	return true
+}
+
 func hasImagePullSecret(sa *corev1.ServiceAccount, secretKey string) bool {
 	found := false
 	if len(sa.ImagePullSecrets) > 0 {
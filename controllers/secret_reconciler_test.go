@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	v1 "alexellis/registry-creds/api/v1"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func testScheme(t *testing.T) *runtime.Scheme {
+	t.Helper()
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return scheme
+}
+
+func testSecretReconciler(t *testing.T, objects ...client.Object) *SecretReconciler {
+	t.Helper()
+
+	scheme := testScheme(t)
+	return &SecretReconciler{
+		Client:   fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build(),
+		Log:      logr.Discard(),
+		Scheme:   scheme,
+		Recorder: record.NewFakeRecorder(10),
+	}
+}
+
+func Test_SecretReconciler_Reconcile_TerminatingNamespace(t *testing.T) {
+	seed := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "seed", Namespace: "kube-system"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(`{"auths":{"ghcr.io":{"auth":"YWxleDpzZWNyZXQ="}}}`),
+		},
+	}
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "team"},
+		Status:     corev1.NamespaceStatus{Phase: corev1.NamespaceTerminating},
+	}
+	clusterPullSecret := v1.ClusterPullSecret{
+		ObjectMeta: metav1.ObjectMeta{Name: "registry", UID: "uid"},
+		Spec: v1.ClusterPullSecretSpec{
+			SecretRef: &v1.ObjectMeta{Name: "seed", Namespace: "kube-system"},
+		},
+	}
+
+	r := testSecretReconciler(t, seed, namespace)
+
+	inScope, err := r.namespaceInScope(clusterPullSecret, namespace)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if inScope {
+		t.Error("want a terminating namespace to be out of scope")
+	}
+
+	if err := r.Reconcile(clusterPullSecret, "team"); err != nil {
+		t.Fatalf("want a terminating namespace to be skipped, got: %s", err)
+	}
+
+	copied := &corev1.Secret{}
+	err = r.Get(context.Background(), client.ObjectKey{Name: "registry" + secretSuffix, Namespace: "team"}, copied)
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("want no copy in a terminating namespace, got: %v", err)
+	}
+}
+
+func Test_SecretReconciler_MissingCopy(t *testing.T) {
+	clusterPullSecret := v1.ClusterPullSecret{
+		ObjectMeta: metav1.ObjectMeta{Name: "registry", UID: "uid"},
+	}
+	secretKey := "registry" + secretSuffix
+
+	tests := []struct {
+		name      string
+		objects   []client.Object
+		wantNames []string
+	}{
+		{
+			name: "copy already deleted",
+		},
+		{
+			name: "Secret of the same name which is not controlled",
+			objects: []client.Object{&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: secretKey, Namespace: "team"},
+			}},
+			wantNames: []string{secretKey},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			objects := append([]client.Object{
+				&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team"}},
+				&corev1.ServiceAccount{
+					ObjectMeta:       metav1.ObjectMeta{Name: "default", Namespace: "team"},
+					ImagePullSecrets: []corev1.LocalObjectReference{{Name: secretKey}},
+				},
+			}, test.objects...)
+
+			for name, cleanup := range map[string]func(r *SecretReconciler) error{
+				"release":  func(r *SecretReconciler) error { return r.release(clusterPullSecret) },
+				"withdraw": func(r *SecretReconciler) error { return r.withdraw(clusterPullSecret, "team") },
+			} {
+				r := testSecretReconciler(t, objects...)
+				if err := cleanup(r); err != nil {
+					t.Fatalf("%s: unexpected error: %s", name, err)
+				}
+
+				sa := &corev1.ServiceAccount{}
+				if err := r.Get(context.Background(), client.ObjectKey{Name: "default", Namespace: "team"}, sa); err != nil {
+					t.Fatal(err)
+				}
+				var gotNames []string
+				for _, ref := range sa.ImagePullSecrets {
+					gotNames = append(gotNames, ref.Name)
+				}
+				if len(gotNames) != len(test.wantNames) {
+					t.Errorf("%s: want imagePullSecrets %v, got: %v", name, test.wantNames, gotNames)
+				}
+			}
+		})
+	}
+}
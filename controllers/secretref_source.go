@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	v1 "alexellis/registry-creds/api/v1"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const secretRefSourceName = "secretRef"
+
+// secretRefSource reads the seed secrets of secretRef and secretRefs
+type secretRefSource struct {
+	client.Client
+}
+
+func newSecretRefSource(c client.Client) CredentialSource {
+	return &secretRefSource{Client: c}
+}
+
+func (s *secretRefSource) Name() string {
+	return secretRefSourceName
+}
+
+func (s *secretRefSource) Configured(clusterPullSecret v1.ClusterPullSecret) bool {
+	return len(seedRefs(clusterPullSecret)) > 0
+}
+
+// Credentials fetches each seed secret, converting legacy formats to a
+// .dockerconfigjson. A single seed is returned as-is, whilst multiple seeds
+// are merged, with the earliest seed taking precedence.
+func (s *secretRefSource) Credentials(ctx context.Context, clusterPullSecret v1.ClusterPullSecret) ([]byte, time.Time, error) {
+	var configs []*dockerConfigJSON
+	var seeds []*corev1.Secret
+
+	for _, ref := range seedRefs(clusterPullSecret) {
+		if ref.Name == "" || ref.Namespace == "" {
+			return nil, time.Time{}, terminalErrorf("no valid secretRef found on ClusterPullSecret: %s.%s",
+				clusterPullSecret.Name,
+				clusterPullSecret.Namespace)
+		}
+
+		seed := &corev1.Secret{}
+		if err := s.Get(ctx, client.ObjectKey{Name: ref.Name, Namespace: ref.Namespace}, seed); err != nil {
+			return nil, time.Time{}, errors.Wrapf(err, "unable to fetch seedSecret %s.%s", ref.Name, ref.Namespace)
+		}
+
+		setSeedLastModified(clusterPullSecret.Name, ref, lastModified(seed))
+
+		seed, err := convertSeedSecret(seed)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+
+		// Reject invalid seeds before any copies are written
+		if err := validateSeedSecret(seed); err != nil {
+			return nil, time.Time{}, err
+		}
+
+		config, err := parseDockerConfigJSON(seed)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		seeds = append(seeds, seed)
+		configs = append(configs, config)
+	}
+
+	if len(seeds) == 1 {
+		return seeds[0].Data[corev1.DockerConfigJsonKey], time.Time{}, nil
+	}
+
+	data, err := json.Marshal(mergeDockerConfigs(configs))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return data, time.Time{}, nil
+}
+
+// seedRefs returns the seed secrets of the ClusterPullSecret
+// in order of precedence.
+func seedRefs(clusterPullSecret v1.ClusterPullSecret) []v1.ObjectMeta {
+	var refs []v1.ObjectMeta
+	if clusterPullSecret.Spec.SecretRef != nil {
+		refs = append(refs, *clusterPullSecret.Spec.SecretRef)
+	}
+	return append(refs, clusterPullSecret.Spec.SecretRefs...)
+}
+
+// lastModified returns when the secret was last written, from its
+// managed fields, or when it was created if there are none
+func lastModified(secret *corev1.Secret) time.Time {
+	modified := secret.CreationTimestamp.Time
+	for _, entry := range secret.ManagedFields {
+		if entry.Time != nil && entry.Time.After(modified) {
+			modified = entry.Time.Time
+		}
+	}
+	return modified
+}
@@ -26,7 +26,9 @@ import (
 
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
@@ -34,8 +36,10 @@ import (
 // ServiceAccountWatcher reconciles a ServiceAccount object
 type ServiceAccountWatcher struct {
 	client.Client
-	Log    logr.Logger
-	Scheme *runtime.Scheme
+	Log              logr.Logger
+	Scheme           *runtime.Scheme
+	Recorder         record.EventRecorder
+	SecretReconciler *SecretReconciler
 }
 
 // +kubebuilder:rbac:groups=core,resources=serviceaccounts,verbs=get;list;watch;create;update;patch;delete
@@ -46,28 +50,104 @@ func (r *ServiceAccountWatcher) Reconcile(ctx context.Context, req ctrl.Request)
 
 	var sa corev1.ServiceAccount
 	if err := r.Get(ctx, req.NamespacedName, &sa); err != nil {
-		r.Log.Info(fmt.Sprintf("%s", errors.Wrap(err, "unable to fetch serviceaccount")))
-		return ctrl.Result{}, nil
+		if kerrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		err = errors.Wrap(err, "unable to fetch serviceaccount")
+		r.Log.Info(err.Error())
+		return reconcileResult(err)
 	}
 
 	r.Log.V(10).Info(fmt.Sprintf("detected a change in serviceaccount: %s", sa.Name))
 
+	var namespace corev1.Namespace
+	if err := r.Get(ctx, client.ObjectKey{Name: sa.Namespace}, &namespace); err != nil {
+		if kerrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		err = errors.Wrap(err, "unable to fetch namespace")
+		r.Log.Info(err.Error())
+		return reconcileResult(err)
+	}
+
+	// The ServiceAccount is deleted along with its namespace
+	if terminatingNamespace(&namespace) {
+		return ctrl.Result{}, nil
+	}
+
 	pullSecretList := &v1.ClusterPullSecretList{}
 	err := r.Client.List(ctx, pullSecretList)
 	if err != nil {
 		r.Log.Info(fmt.Sprintf("unable to list ClusterPullSecrets, %s", err.Error()))
-		return ctrl.Result{}, nil
+		return reconcileResult(err)
 	}
 
+	var errs []error
 	for _, clusterPullSecret := range pullSecretList.Items {
-		err = r.appendSecretToSA(clusterPullSecret, sa.Namespace, sa.Name)
+		if !clusterPullSecret.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		inScope, err := r.SecretReconciler.namespaceInScope(clusterPullSecret, &namespace)
 		if err != nil {
 			r.Log.Info(err.Error())
-			return ctrl.Result{}, nil
+			errs = append(errs, err)
+			continue
+		}
+		if !inScope {
+			continue
+		}
+
+		selected, err := selectedServiceAccount(clusterPullSecret, &sa)
+		if err != nil {
+			r.Log.Info(err.Error())
+			errs = append(errs, err)
+			continue
+		}
+
+		if !selected {
+			secretKey := clusterPullSecret.Name + secretSuffix
+
+			// A Secret of the same name which the ClusterPullSecret does
+			// not control may be referenced by the user's own ServiceAccounts
+			nsSecret := &corev1.Secret{}
+			if err := r.Get(ctx, client.ObjectKey{Name: secretKey, Namespace: sa.Namespace}, nsSecret); err != nil {
+				if kerrors.IsNotFound(err) {
+					continue
+				}
+				err = errors.Wrap(err, "unexpected error checking for the namespaced pull secret")
+				r.Log.Info(err.Error())
+				errs = append(errs, err)
+				continue
+			}
+			if !metav1.IsControlledBy(nsSecret, &clusterPullSecret) {
+				continue
+			}
+
+			removed, err := removeSecretFromSA(ctx, r.Client, sa, secretKey)
+			if err != nil {
+				r.Log.Info(err.Error())
+				errs = append(errs, err)
+				continue
+			}
+			if removed {
+				r.Log.Info(fmt.Sprintf("removed pull secret %s from unselected service account: %s.%s", secretKey, sa.Name, sa.Namespace))
+			}
+			continue
+		}
+
+		err = r.appendSecretToSA(clusterPullSecret, sa.Namespace, sa.Name)
+		if err != nil {
+			// A conflict means the ServiceAccount changed, so it is
+			// requeued without being logged as a failure
+			if !kerrors.IsConflict(err) {
+				r.Log.Info(err.Error())
+			}
+			errs = append(errs, err)
 		}
 	}
 
-	return ctrl.Result{}, nil
+	return reconcileResult(errs...)
 }
 
 func (r *ServiceAccountWatcher) appendSecretToSA(clusterPullSecret v1.ClusterPullSecret, ns, serviceAccountName string) error {
@@ -77,15 +157,8 @@ func (r *ServiceAccountWatcher) appendSecretToSA(clusterPullSecret v1.ClusterPul
 
 	sa := &corev1.ServiceAccount{}
 	if err := r.Client.Get(ctx, client.ObjectKey{Name: serviceAccountName, Namespace: ns}, sa); err != nil {
-		if !kerrors.IsConflict(err) {
-
-			r.Log.Info(fmt.Sprintf("error getting SA in namespace: %s, %s", ns, err.Error()))
-			wrappedErr := fmt.Errorf("unable to append pull secret to service account: %s", err)
-			r.Log.Info(wrappedErr.Error())
-			return wrappedErr
-		}
-		return nil
-
+		r.Log.Info(fmt.Sprintf("error getting SA in namespace: %s, %s", ns, err.Error()))
+		return errors.Wrap(err, "unable to append pull secret to service account")
 	}
 
 	r.Log.V(10).Info(fmt.Sprintf("Pull secrets: %v", sa.ImagePullSecrets))
@@ -99,13 +172,14 @@ func (r *ServiceAccountWatcher) appendSecretToSA(clusterPullSecret v1.ClusterPul
 
 		if err := r.Update(ctx, sa.DeepCopy()); err != nil {
 			if !kerrors.IsConflict(err) {
-
-				wrappedErr := fmt.Errorf("unable to append pull secret to service account: %s", err)
-				r.Log.Info(wrappedErr.Error())
-				return err
+				r.Recorder.Eventf(sa, corev1.EventTypeWarning, "PullSecretAttachFailed",
+					"Unable to attach pull secret %s: %s", secretKey, err)
 			}
-			return nil
+			return errors.Wrap(err, "unable to append pull secret to service account")
 		}
+		r.Recorder.Eventf(sa, corev1.EventTypeNormal, "PullSecretAttached",
+			"Attached pull secret %s of ClusterPullSecret %s", secretKey, clusterPullSecret.Name)
+		serviceAccountsPatched.WithLabelValues(clusterPullSecret.Name, operationAttach).Inc()
 	}
 
 	return nil
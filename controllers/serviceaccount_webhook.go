@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// ServiceAccountWebhookPath is where the ServiceAccountInjector is served
+const ServiceAccountWebhookPath = "/mutate-v1-serviceaccount"
+
+// +kubebuilder:webhook:path=/mutate-v1-serviceaccount,mutating=true,failurePolicy=ignore,sideEffects=None,groups="",resources=serviceaccounts,verbs=create,versions=v1,name=mserviceaccount.registry-creds.alexellis.io,admissionReviewVersions=v1
+
+// ServiceAccountInjector adds pull secrets to the imagePullSecrets of new
+// ServiceAccounts, so that they are correct from their first revision and
+// the ServiceAccountWatcher does not need to update them.
+type ServiceAccountInjector struct {
+	Client           client.Client
+	Log              logr.Logger
+	Decoder          *admission.Decoder
+	SecretReconciler *SecretReconciler
+}
+
+// Handle adds the pull secret of each ClusterPullSecret which is in scope
+// for the ServiceAccount. The pull secret may not have been created in a
+// new namespace yet, and is then created by the controller shortly after.
+// ServiceAccounts are always admitted, and are left unchanged when an
+// error occurs.
+func (r *ServiceAccountInjector) Handle(ctx context.Context, req admission.Request) admission.Response {
+	sa := &corev1.ServiceAccount{}
+	if err := r.Decoder.Decode(req, sa); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	namespace := &corev1.Namespace{}
+	if err := r.Client.Get(ctx, client.ObjectKey{Name: req.Namespace}, namespace); err != nil {
+		r.Log.Info(fmt.Sprintf("unable to inject pull secrets into service account %s.%s, error: %s", sa.Name, req.Namespace, err))
+		return admission.Allowed(err.Error())
+	}
+	if terminatingNamespace(namespace) {
+		return admission.Allowed("")
+	}
+
+	pullSecrets, err := r.SecretReconciler.pullSecretsInScope(ctx, namespace, sa)
+	if err != nil {
+		r.Log.Info(fmt.Sprintf("unable to inject pull secrets into service account %s.%s, error: %s", sa.Name, req.Namespace, err))
+		return admission.Allowed(err.Error())
+	}
+
+	changed := false
+	for _, pullSecret := range pullSecrets {
+		secretKey := pullSecret.Name + secretSuffix
+		if !hasImagePullSecret(sa, secretKey) {
+			sa.ImagePullSecrets = append(sa.ImagePullSecrets, corev1.LocalObjectReference{
+				Name: secretKey,
+			})
+			changed = true
+		}
+	}
+
+	if !changed {
+		return admission.Allowed("")
+	}
+
+	marshaled, err := json.Marshal(sa)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	r.Log.V(10).Info(fmt.Sprintf("injecting pull secrets into service account %s.%s", sa.Name, req.Namespace))
+
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
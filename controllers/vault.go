@@ -0,0 +1,300 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	v1 "alexellis/registry-creds/api/v1"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// vaultTokenKey is the key of the Secret referenced
+// by VaultAuth.TokenSecretRef
+const vaultTokenKey = "token"
+
+const (
+	vaultDefaultMount           = "secret"
+	vaultDefaultKubernetesMount = "kubernetes"
+	vaultDefaultTokenFile       = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+// Environment variables of the controller which configure the vault
+// source. The token file is not part of the spec, and the Kubernetes auth
+// method only logs into VAULT_ADDR or one of the comma-separated
+// VAULT_ALLOWED_ADDRS, since anyone who can edit a ClusterPullSecret could
+// otherwise send the token of the controller to a server of their choosing.
+const (
+	vaultAddressEnv          = "VAULT_ADDR"
+	vaultAllowedAddressesEnv = "VAULT_ALLOWED_ADDRS"
+	vaultTokenFileEnv        = "VAULT_KUBERNETES_TOKEN_FILE"
+)
+
+// vaultDefaultRefreshInterval is how often a Vault secret is read
+// when no refreshInterval is set
+const vaultDefaultRefreshInterval = 5 * time.Minute
+
+type vaultLoginResponse struct {
+	Auth struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+}
+
+type vaultKVResponse struct {
+	Data struct {
+		Data map[string]interface{} `json:"data"`
+	} `json:"data"`
+}
+
+// vaultSource reads credentials from HashiCorp Vault
+type vaultSource struct {
+	client.Client
+}
+
+func newVaultSource(c client.Client) CredentialSource {
+	return &vaultSource{Client: c}
+}
+
+func (s *vaultSource) Name() string {
+	return "vault"
+}
+
+func (s *vaultSource) Configured(clusterPullSecret v1.ClusterPullSecret) bool {
+	return clusterPullSecret.Spec.Source != nil && clusterPullSecret.Spec.Source.Vault != nil
+}
+
+// Credentials reads the secret from the KV version 2 secrets engine and
+// converts it to a .dockerconfigjson in the same way as a seed secret.
+func (s *vaultSource) Credentials(ctx context.Context, clusterPullSecret v1.ClusterPullSecret) ([]byte, time.Time, error) {
+	source := clusterPullSecret.Spec.Source.Vault
+	if source.Path == "" {
+		return nil, time.Time{}, terminalErrorf("a path is required for the vault source")
+	}
+
+	address := source.Address
+	if address == "" {
+		address = os.Getenv(vaultAddressEnv)
+	}
+	if address == "" {
+		return nil, time.Time{}, terminalErrorf("an address, or %s on the controller, is required for the vault source", vaultAddressEnv)
+	}
+	address = strings.TrimSuffix(address, "/")
+
+	if source.Auth.TokenSecretRef == nil && !vaultAddressAllowed(address) {
+		return nil, time.Time{}, terminalErrorf("the kubernetes auth method may only be used with %s or %s of the controller, not: %s",
+			vaultAddressEnv, vaultAllowedAddressesEnv, address)
+	}
+
+	token, err := s.vaultToken(ctx, address, source)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	mount := source.Mount
+	if mount == "" {
+		mount = vaultDefaultMount
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/%s/data/%s", address, strings.Trim(mount, "/"), strings.TrimPrefix(source.Path, "/"))
+
+	res := vaultKVResponse{}
+	if err := vaultRequest(ctx, http.MethodGet, endpoint, token, source.Namespace, nil, &res); err != nil {
+		return nil, time.Time{}, errors.Wrapf(err, "unable to read Vault secret %s/%s", mount, source.Path)
+	}
+
+	secret, err := vaultSeedSecret(res.Data.Data, source.Keys)
+	if err != nil {
+		return nil, time.Time{}, errors.Wrapf(err, "unable to read Vault secret %s/%s", mount, source.Path)
+	}
+
+	secret, err = convertSeedSecret(secret)
+	if err == nil {
+		err = validateSeedSecret(secret)
+	}
+	if err != nil {
+		var invalidSeed *invalidSeedError
+		if errors.As(err, &invalidSeed) {
+			return nil, time.Time{}, fmt.Errorf("invalid Vault secret %s/%s: %s", mount, source.Path, invalidSeed.reason)
+		}
+		return nil, time.Time{}, err
+	}
+
+	return secret.Data[corev1.DockerConfigJsonKey], time.Time{}, nil
+}
+
+// RefreshInterval returns how often the secret is read again, since
+// secrets of the KV secrets engine do not expire, but may be changed
+func (s *vaultSource) RefreshInterval(clusterPullSecret v1.ClusterPullSecret) time.Duration {
+	source := clusterPullSecret.Spec.Source.Vault
+	if source.RefreshInterval != nil && source.RefreshInterval.Duration > 0 {
+		return source.RefreshInterval.Duration
+	}
+	return vaultDefaultRefreshInterval
+}
+
+// vaultAddressAllowed returns true when the ServiceAccount token of the
+// controller may be sent to address, which is VAULT_ADDR or one of
+// VAULT_ALLOWED_ADDRS
+func vaultAddressAllowed(address string) bool {
+	allowed := append([]string{os.Getenv(vaultAddressEnv)}, strings.Split(os.Getenv(vaultAllowedAddressesEnv), ",")...)
+	for _, allowedAddress := range allowed {
+		allowedAddress = strings.TrimSuffix(strings.TrimSpace(allowedAddress), "/")
+		if allowedAddress != "" && strings.EqualFold(allowedAddress, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// vaultToken returns a token from the Secret referenced by the source,
+// or logs in with the Kubernetes auth method.
+func (s *vaultSource) vaultToken(ctx context.Context, address string, source *v1.VaultSource) (string, error) {
+	if ref := source.Auth.TokenSecretRef; ref != nil {
+		secret := &corev1.Secret{}
+		if err := s.Get(ctx, client.ObjectKey{Name: ref.Name, Namespace: ref.Namespace}, secret); err != nil {
+			return "", errors.Wrapf(err, "unable to fetch tokenSecretRef %s.%s", ref.Name, ref.Namespace)
+		}
+
+		token := strings.TrimSpace(string(secret.Data[vaultTokenKey]))
+		if token == "" {
+			return "", fmt.Errorf("tokenSecretRef %s.%s has no %s key", ref.Name, ref.Namespace, vaultTokenKey)
+		}
+		return token, nil
+	}
+
+	auth := source.Auth.Kubernetes
+	if auth == nil || auth.Role == "" {
+		return "", terminalErrorf("a tokenSecretRef or kubernetes role is required for the vault source")
+	}
+
+	mount := auth.Mount
+	if mount == "" {
+		mount = vaultDefaultKubernetesMount
+	}
+	tokenFile := os.Getenv(vaultTokenFileEnv)
+	if tokenFile == "" {
+		tokenFile = vaultDefaultTokenFile
+	}
+
+	jwt, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to read ServiceAccount token")
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"role": auth.Role,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/auth/%s/login", address, strings.Trim(mount, "/"))
+
+	res := vaultLoginResponse{}
+	if err := vaultRequest(ctx, http.MethodPost, endpoint, "", source.Namespace, body, &res); err != nil {
+		return "", errors.Wrap(err, "unable to log into Vault with the kubernetes auth method")
+	}
+
+	if res.Auth.ClientToken == "" {
+		return "", fmt.Errorf("no client_token returned by Vault")
+	}
+
+	return res.Auth.ClientToken, nil
+}
+
+// vaultSeedSecret maps the fields of a Vault secret onto a secret of type
+// dockerconfigjson, or basic-auth when there is no .dockerconfigjson field.
+func vaultSeedSecret(data map[string]interface{}, keys *v1.VaultKeys) (*corev1.Secret, error) {
+	if keys == nil {
+		keys = &v1.VaultKeys{}
+	}
+
+	field := func(key, defaultKey string) ([]byte, error) {
+		if key == "" {
+			key = defaultKey
+		}
+		value, ok := data[key]
+		if !ok || value == nil {
+			return nil, nil
+		}
+		if str, ok := value.(string); ok {
+			return []byte(str), nil
+		}
+		// A .dockerconfigjson may be stored as an object rather than a string
+		return json.Marshal(value)
+	}
+
+	dockerConfig, err := field(keys.DockerConfigJSON, corev1.DockerConfigJsonKey)
+	if err != nil {
+		return nil, err
+	}
+	if dockerConfig != nil {
+		return &corev1.Secret{
+			Data: map[string][]byte{
+				corev1.DockerConfigJsonKey: dockerConfig,
+			},
+			Type: corev1.SecretTypeDockerConfigJson,
+		}, nil
+	}
+
+	secret := &corev1.Secret{
+		Data: map[string][]byte{},
+		Type: corev1.SecretTypeBasicAuth,
+	}
+	for secretKey, mapping := range map[string][2]string{
+		corev1.BasicAuthUsernameKey: {keys.Username, corev1.BasicAuthUsernameKey},
+		corev1.BasicAuthPasswordKey: {keys.Password, corev1.BasicAuthPasswordKey},
+		seedServerKey:               {keys.Server, seedServerKey},
+		seedEmailKey:                {keys.Email, seedEmailKey},
+	} {
+		value, err := field(mapping[0], mapping[1])
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			secret.Data[secretKey] = value
+		}
+	}
+
+	return secret, nil
+}
+
+// vaultRequest calls the HTTP API of Vault and decodes the JSON response into out
+func vaultRequest(ctx context.Context, method, endpoint, token, namespace string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	resBody, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d, body: %s", res.StatusCode, strings.TrimSpace(string(resBody)))
+	}
+
+	return json.Unmarshal(resBody, out)
+}
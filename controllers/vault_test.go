@@ -0,0 +1,251 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v1 "alexellis/registry-creds/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// vaultTestServer stands in for Vault with the Kubernetes auth method
+// and a KV version 2 secrets engine, which only issues a token for jwt
+func vaultTestServer(jwt string) *httptest.Server {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/v1/auth/kubernetes/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+			return
+		}
+		login := map[string]string{}
+		if err := json.NewDecoder(r.Body).Decode(&login); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if login["role"] != "registry-creds" || login["jwt"] != jwt {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		if r.Header.Get("X-Vault-Namespace") != "team" {
+			http.Error(w, `{"errors":["unexpected namespace"]}`, http.StatusBadRequest)
+			return
+		}
+
+		fmt.Fprint(w, `{"auth":{"client_token":"hvs.client-token"}}`)
+	})
+
+	mux.HandleFunc("/v1/secret/data/registry/ghcr", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("X-Vault-Token") != "hvs.client-token" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+
+		fmt.Fprint(w, `{"data":{"data":{"server":"ghcr.io","username":"alex","password":"ghcr-token"},"metadata":{"version":3}}}`)
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func Test_vaultSource_Credentials_KubernetesAuth(t *testing.T) {
+	server := vaultTestServer("service-account-token")
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("service-account-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(vaultAddressEnv, server.URL+"/")
+	t.Setenv(vaultTokenFileEnv, tokenFile)
+
+	source := &vaultSource{Client: fake.NewClientBuilder().Build()}
+	clusterPullSecret := v1.ClusterPullSecret{
+		Spec: v1.ClusterPullSecretSpec{
+			Source: &v1.Source{
+				Vault: &v1.VaultSource{
+					Namespace: "team",
+					Path:      "registry/ghcr",
+					Auth: v1.VaultAuth{
+						Kubernetes: &v1.VaultKubernetesAuth{Role: "registry-creds"},
+					},
+				},
+			},
+		},
+	}
+
+	data, expiry, err := source.Credentials(context.Background(), clusterPullSecret)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !expiry.IsZero() {
+		t.Errorf("want no expiry for a Vault secret, got: %s", expiry)
+	}
+
+	config := dockerConfigJSON{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatal(err)
+	}
+	entry, ok := config.Auths["ghcr.io"]
+	if !ok {
+		t.Fatalf("want an entry for ghcr.io, got: %s", data)
+	}
+	if entry.Username != "alex" || entry.Password != "ghcr-token" {
+		t.Errorf("want alex:ghcr-token, got: %s:%s", entry.Username, entry.Password)
+	}
+
+	if got := source.RefreshInterval(clusterPullSecret); got != vaultDefaultRefreshInterval {
+		t.Errorf("want the default refresh interval %s, got: %s", vaultDefaultRefreshInterval, got)
+	}
+
+	clusterPullSecret.Spec.Source.Vault.RefreshInterval = &metav1.Duration{Duration: time.Minute}
+	if got := source.RefreshInterval(clusterPullSecret); got != time.Minute {
+		t.Errorf("want a refresh interval of 1m, got: %s", got)
+	}
+}
+
+func Test_vaultSource_Credentials_LoginDenied(t *testing.T) {
+	server := vaultTestServer("service-account-token")
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("another-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(vaultAddressEnv, server.URL)
+	t.Setenv(vaultTokenFileEnv, tokenFile)
+
+	source := &vaultSource{Client: fake.NewClientBuilder().Build()}
+
+	_, _, err := source.Credentials(context.Background(), v1.ClusterPullSecret{
+		Spec: v1.ClusterPullSecretSpec{
+			Source: &v1.Source{
+				Vault: &v1.VaultSource{
+					Namespace: "team",
+					Path:      "registry/ghcr",
+					Auth: v1.VaultAuth{
+						Kubernetes: &v1.VaultKubernetesAuth{Role: "registry-creds"},
+					},
+				},
+			},
+		},
+	})
+	if err == nil {
+		t.Fatal("want an error when the login is denied")
+	}
+}
+
+func Test_vaultSource_Credentials_NoAddress(t *testing.T) {
+	t.Setenv(vaultAddressEnv, "")
+
+	source := &vaultSource{Client: fake.NewClientBuilder().Build()}
+
+	_, _, err := source.Credentials(context.Background(), v1.ClusterPullSecret{
+		Spec: v1.ClusterPullSecretSpec{
+			Source: &v1.Source{
+				Vault: &v1.VaultSource{
+					Path: "registry/ghcr",
+					Auth: v1.VaultAuth{
+						Kubernetes: &v1.VaultKubernetesAuth{Role: "registry-creds"},
+					},
+				},
+			},
+		},
+	})
+	if err == nil || !isTerminal(err) {
+		t.Fatalf("want a terminal error without %s, got: %v", vaultAddressEnv, err)
+	}
+}
+
+func Test_vaultSource_Credentials_Address(t *testing.T) {
+	server := vaultTestServer("service-account-token")
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("service-account-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(vaultTokenFileEnv, tokenFile)
+
+	tokenSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "vault-token", Namespace: "kube-system"},
+		Data: map[string][]byte{
+			vaultTokenKey: []byte("hvs.client-token"),
+		},
+	}
+	kubernetesAuth := v1.VaultAuth{Kubernetes: &v1.VaultKubernetesAuth{Role: "registry-creds"}}
+	tokenAuth := v1.VaultAuth{TokenSecretRef: &v1.ObjectMeta{Name: "vault-token", Namespace: "kube-system"}}
+
+	tests := []struct {
+		name         string
+		vaultAddr    string
+		allowedAddrs string
+		auth         v1.VaultAuth
+		wantTerminal bool
+	}{
+		{
+			name:         "kubernetes auth with an address which is not allowed",
+			vaultAddr:    "https://vault.vault:8200",
+			auth:         kubernetesAuth,
+			wantTerminal: true,
+		},
+		{
+			name:         "kubernetes auth with an allowed address",
+			vaultAddr:    "https://vault.vault:8200",
+			allowedAddrs: "https://vault.team-a:8200, " + server.URL + "/",
+			auth:         kubernetesAuth,
+		},
+		{
+			name: "tokenSecretRef with any address",
+			auth: tokenAuth,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(vaultAddressEnv, test.vaultAddr)
+			t.Setenv(vaultAllowedAddressesEnv, test.allowedAddrs)
+
+			source := &vaultSource{Client: fake.NewClientBuilder().WithObjects(tokenSecret).Build()}
+
+			_, _, err := source.Credentials(context.Background(), v1.ClusterPullSecret{
+				Spec: v1.ClusterPullSecretSpec{
+					Source: &v1.Source{
+						Vault: &v1.VaultSource{
+							Address:   server.URL,
+							Namespace: "team",
+							Path:      "registry/ghcr",
+							Auth:      test.auth,
+						},
+					},
+				},
+			})
+
+			if test.wantTerminal {
+				if err == nil || !isTerminal(err) {
+					t.Fatalf("want a terminal error, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,371 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// webhookCertValidity is how long the CA and serving certificate are valid
+const webhookCertValidity = 365 * 24 * time.Hour
+
+// webhookCertRotateBefore is how long before expiry the
+// CA and serving certificate are replaced
+const webhookCertRotateBefore = 30 * 24 * time.Hour
+
+// webhookCertCheckInterval is how often the certificates are checked
+const webhookCertCheckInterval = time.Hour
+
+// webhookCABundleKey holds the CA bundle in the Secret, which includes
+// the previous CA until it expires, so that a rotation does not break
+// connections from API servers which have not seen the new bundle yet
+const webhookCABundleKey = "ca.crt"
+
+// +kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=mutatingwebhookconfigurations,verbs=get;update;patch,resourceNames=registry-creds-mutating-webhook-configuration
+// +kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=validatingwebhookconfigurations,verbs=get;update;patch,resourceNames=registry-creds-validating-webhook-configuration
+
+// WebhookCertManager generates a self-signed CA and serving certificate
+// for the webhook server, stores them in a Secret so that each replica
+// shares them, and writes the CA bundle into the webhooks of its
+// configurations which call the webhook Service. Certificates are
+// rotated before expiry.
+type WebhookCertManager struct {
+	// Client should read from the API server directly, as Sync
+	// is called before the cache of the manager is started
+	Client client.Client
+	Log    logr.Logger
+
+	// SecretName is the Secret holding the certificates, in Namespace
+	SecretName string
+
+	// Namespace of the controller, its Secret and Service
+	Namespace string
+
+	// ServiceName is the Service of the webhook server
+	ServiceName string
+
+	// MutatingWebhookConfiguration and ValidatingWebhookConfiguration
+	// are the names of the configurations whose caBundle is patched,
+	// the controller is only granted access to these names
+	MutatingWebhookConfiguration   string
+	ValidatingWebhookConfiguration string
+
+	// CertDir is where tls.crt and tls.key are written
+	// for the webhook server
+	CertDir string
+}
+
+// Start checks the certificates on an interval, until ctx is cancelled
+func (m *WebhookCertManager) Start(ctx context.Context) error {
+	ticker := time.NewTicker(webhookCertCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := m.Sync(ctx); err != nil {
+				m.Log.Info(fmt.Sprintf("unable to sync webhook certificates, error: %s", err))
+			}
+		}
+	}
+}
+
+// NeedLeaderElection returns false, as every replica serves the webhooks
+func (m *WebhookCertManager) NeedLeaderElection() bool {
+	return false
+}
+
+// Sync creates or rotates the certificates held in the Secret, then
+// patches the webhook configurations and writes them to CertDir. The
+// caBundle is patched first, as it holds both the new and previous CA,
+// so that the API server trusts the new certificate before it is served.
+func (m *WebhookCertManager) Sync(ctx context.Context) error {
+	secret, err := m.ensureSecret(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := m.patchCABundles(ctx, secret.Data[webhookCABundleKey]); err != nil {
+		return err
+	}
+
+	if err := m.writeCertFiles(secret); err != nil {
+		return errors.Wrap(err, "unable to write webhook certificates")
+	}
+	return nil
+}
+
+// ensureSecret returns the Secret holding the certificates, first
+// creating it, or replacing certificates which are about to expire
+func (m *WebhookCertManager) ensureSecret(ctx context.Context) (*corev1.Secret, error) {
+	key := client.ObjectKey{Name: m.SecretName, Namespace: m.Namespace}
+
+	secret := &corev1.Secret{}
+	if err := m.Client.Get(ctx, key, secret); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      m.SecretName,
+				Namespace: m.Namespace,
+			},
+			Type: corev1.SecretTypeTLS,
+		}
+		if secret.Data, err = generateWebhookCerts(m.dnsNames(), nil); err != nil {
+			return nil, err
+		}
+
+		if err := m.Client.Create(ctx, secret); err != nil {
+			if !apierrors.IsAlreadyExists(err) {
+				return nil, err
+			}
+
+			// Another replica created the Secret first
+			if err := m.Client.Get(ctx, key, secret); err != nil {
+				return nil, err
+			}
+			return secret, nil
+		}
+
+		m.Log.Info(fmt.Sprintf("created webhook certificates in Secret %s.%s", m.SecretName, m.Namespace))
+		return secret, nil
+	}
+
+	if validWebhookCert(secret.Data[corev1.TLSCertKey], m.dnsNames()) {
+		return secret, nil
+	}
+
+	data, err := generateWebhookCerts(m.dnsNames(), secret.Data[webhookCABundleKey])
+	if err != nil {
+		return nil, err
+	}
+	secret.Data = data
+
+	if err := m.Client.Update(ctx, secret); err != nil {
+		return nil, err
+	}
+
+	m.Log.Info(fmt.Sprintf("rotated webhook certificates in Secret %s.%s", m.SecretName, m.Namespace))
+	return secret, nil
+}
+
+func (m *WebhookCertManager) dnsNames() []string {
+	return []string{
+		m.ServiceName,
+		fmt.Sprintf("%s.%s", m.ServiceName, m.Namespace),
+		fmt.Sprintf("%s.%s.svc", m.ServiceName, m.Namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", m.ServiceName, m.Namespace),
+	}
+}
+
+// writeCertFiles writes tls.crt and tls.key when they have changed, the
+// webhook server watches the files and reloads them without a restart
+func (m *WebhookCertManager) writeCertFiles(secret *corev1.Secret) error {
+	if err := os.MkdirAll(m.CertDir, 0700); err != nil {
+		return err
+	}
+
+	for _, name := range []string{corev1.TLSPrivateKeyKey, corev1.TLSCertKey} {
+		file := filepath.Join(m.CertDir, name)
+
+		current, err := os.ReadFile(file)
+		if err == nil && bytes.Equal(current, secret.Data[name]) {
+			continue
+		}
+
+		if err := os.WriteFile(file, secret.Data[name], 0600); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// patchCABundles sets the caBundle of each webhook which calls the
+// Service, in the configurations named by the WebhookCertManager. A
+// configuration which is not found is skipped, as not every webhook
+// needs to be deployed.
+func (m *WebhookCertManager) patchCABundles(ctx context.Context, caBundle []byte) error {
+	if m.MutatingWebhookConfiguration != "" {
+		config := &admissionregistrationv1.MutatingWebhookConfiguration{}
+		if err := m.Client.Get(ctx, client.ObjectKey{Name: m.MutatingWebhookConfiguration}, config); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return errors.Wrapf(err, "unable to fetch %s", m.MutatingWebhookConfiguration)
+			}
+		} else {
+			changed := false
+			for i := range config.Webhooks {
+				if m.callsService(config.Webhooks[i].ClientConfig) && !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, caBundle) {
+					config.Webhooks[i].ClientConfig.CABundle = caBundle
+					changed = true
+				}
+			}
+
+			if changed {
+				if err := m.Client.Update(ctx, config); err != nil {
+					return errors.Wrapf(err, "unable to patch caBundle of %s", config.Name)
+				}
+				m.Log.Info(fmt.Sprintf("patched caBundle of MutatingWebhookConfiguration %s", config.Name))
+			}
+		}
+	}
+
+	if m.ValidatingWebhookConfiguration != "" {
+		config := &admissionregistrationv1.ValidatingWebhookConfiguration{}
+		if err := m.Client.Get(ctx, client.ObjectKey{Name: m.ValidatingWebhookConfiguration}, config); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return errors.Wrapf(err, "unable to fetch %s", m.ValidatingWebhookConfiguration)
+			}
+		} else {
+			changed := false
+			for i := range config.Webhooks {
+				if m.callsService(config.Webhooks[i].ClientConfig) && !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, caBundle) {
+					config.Webhooks[i].ClientConfig.CABundle = caBundle
+					changed = true
+				}
+			}
+
+			if changed {
+				if err := m.Client.Update(ctx, config); err != nil {
+					return errors.Wrapf(err, "unable to patch caBundle of %s", config.Name)
+				}
+				m.Log.Info(fmt.Sprintf("patched caBundle of ValidatingWebhookConfiguration %s", config.Name))
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *WebhookCertManager) callsService(clientConfig admissionregistrationv1.WebhookClientConfig) bool {
+	return clientConfig.Service != nil &&
+		clientConfig.Service.Name == m.ServiceName &&
+		clientConfig.Service.Namespace == m.Namespace
+}
+
+// validWebhookCert returns true when the serving certificate covers
+// dnsNames, and is not due to be rotated
+func validWebhookCert(certPEM []byte, dnsNames []string) bool {
+	cert, err := parseCertificate(certPEM)
+	if err != nil {
+		return false
+	}
+
+	if time.Now().Add(webhookCertRotateBefore).After(cert.NotAfter) {
+		return false
+	}
+
+	for _, name := range dnsNames {
+		if cert.VerifyHostname(name) != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// generateWebhookCerts creates a CA and a serving certificate signed by
+// it, and returns them as the data of a Secret. The CA bundle holds the
+// new CA, followed by the first CA of previousBundle while it is valid.
+func generateWebhookCerts(dnsNames []string, previousBundle []byte) (map[string][]byte, error) {
+	now := time.Now()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "registry-creds-webhook-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(webhookCertValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(webhookCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	caBundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	if previous, err := parseCertificate(previousBundle); err == nil && now.Before(previous.NotAfter) {
+		caBundle = append(caBundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: previous.Raw})...)
+	}
+
+	return map[string][]byte{
+		corev1.TLSCertKey:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		corev1.TLSPrivateKeyKey: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		webhookCABundleKey:      caBundle,
+	}, nil
+}
+
+// parseCertificate parses the first certificate of a PEM bundle
+func parseCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func randomSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+	return serial
+}
@@ -0,0 +1,208 @@
+package credentialprovider
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// defaultRegistry is the registry of images which do not name one
+const defaultRegistry = "docker.io"
+
+// Provider answers credential requests of the kubelet with the auths
+// of a .dockerconfigjson file, as written by Sync.
+type Provider struct {
+	// ConfigFile is the path of the .dockerconfigjson file
+	ConfigFile string
+
+	// CacheDuration is how long the kubelet caches each response
+	CacheDuration time.Duration
+}
+
+type dockerConfigJSON struct {
+	Auths map[string]dockerConfigEntry `json:"auths"`
+}
+
+type dockerConfigEntry struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Auth     string `json:"auth,omitempty"`
+}
+
+// Run reads a CredentialProviderRequest from in and
+// writes a CredentialProviderResponse to out.
+func (p *Provider) Run(in io.Reader, out io.Writer) error {
+	req := CredentialProviderRequest{}
+	if err := json.NewDecoder(in).Decode(&req); err != nil {
+		return fmt.Errorf("unable to parse request: %w", err)
+	}
+
+	if req.APIVersion != APIVersion || req.Kind != requestKind {
+		return fmt.Errorf("unsupported request %s, %s, only %s, %s is supported",
+			req.APIVersion, req.Kind, APIVersion, requestKind)
+	}
+
+	res, err := p.Provide(req)
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(out).Encode(res)
+}
+
+// Provide returns the credentials of each registry in the config
+// file which matches the image of the request.
+func (p *Provider) Provide(req CredentialProviderRequest) (*CredentialProviderResponse, error) {
+	if req.Image == "" {
+		return nil, fmt.Errorf("no image given in request")
+	}
+
+	config, err := p.readConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	res := &CredentialProviderResponse{
+		APIVersion:   APIVersion,
+		Kind:         responseKind,
+		CacheKeyType: RegistryPluginCacheKeyType,
+		Auth:         map[string]AuthConfig{},
+	}
+	if p.CacheDuration > 0 {
+		res.CacheDuration = &Duration{Duration: p.CacheDuration}
+	}
+
+	image := normalizeImage(req.Image)
+	for registry, entry := range config.Auths {
+		pattern := normalizeRegistry(registry)
+		if !matchesImage(pattern, image) {
+			continue
+		}
+
+		username, password, err := entryCredentials(entry)
+		if err != nil {
+			return nil, fmt.Errorf("registry %s: %w", registry, err)
+		}
+
+		res.Auth[pattern] = AuthConfig{
+			Username: username,
+			Password: password,
+		}
+
+		// The kubelet would share a registry-wide cache entry
+		// between images which match different paths
+		if strings.Contains(pattern, "/") {
+			res.CacheKeyType = ImagePluginCacheKeyType
+		}
+	}
+
+	return res, nil
+}
+
+func (p *Provider) readConfig() (*dockerConfigJSON, error) {
+	data, err := os.ReadFile(p.ConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", p.ConfigFile, err)
+	}
+
+	config := &dockerConfigJSON{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", p.ConfigFile, err)
+	}
+
+	return config, nil
+}
+
+// entryCredentials returns the username and password of an entry,
+// decoding them from the auth field when they are not set
+func entryCredentials(entry dockerConfigEntry) (string, string, error) {
+	if entry.Username != "" && entry.Password != "" {
+		return entry.Username, entry.Password, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to decode auth: %w", err)
+	}
+
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", fmt.Errorf("auth is not in the format username:password")
+	}
+
+	return username, password, nil
+}
+
+// normalizeRegistry strips the scheme and any trailing /v1/ or /v2/
+// from a key of auths, i.e. https://index.docker.io/v1/ is docker.io
+func normalizeRegistry(registry string) string {
+	registry = strings.TrimPrefix(registry, "https://")
+	registry = strings.TrimPrefix(registry, "http://")
+	registry = strings.TrimSuffix(registry, "/")
+	registry = strings.TrimSuffix(registry, "/v1")
+	registry = strings.TrimSuffix(registry, "/v2")
+
+	host, rest, _ := strings.Cut(registry, "/")
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		host = defaultRegistry
+	}
+
+	if rest == "" {
+		return host
+	}
+	return host + "/" + rest
+}
+
+// normalizeImage adds the default registry to images such as nginx
+// or library/nginx, and removes any tag or digest
+func normalizeImage(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+
+	host, _, found := strings.Cut(image, "/")
+	if !found || (!strings.ContainsAny(host, ".:") && host != "localhost") {
+		return defaultRegistry + "/" + image
+	}
+
+	return normalizeRegistry(image)
+}
+
+// matchesImage follows the rules of the kubelet, where each part of the
+// host may be a glob, the ports must be equal, and the path of the
+// pattern must be a prefix of the path of the image.
+func matchesImage(pattern, image string) bool {
+	patternHost, patternPath, _ := strings.Cut(pattern, "/")
+	imageHost, imagePath, _ := strings.Cut(image, "/")
+
+	patternHost, patternPort, _ := strings.Cut(patternHost, ":")
+	imageHost, imagePort, _ := strings.Cut(imageHost, ":")
+	if patternPort != imagePort {
+		return false
+	}
+
+	patternParts := strings.Split(patternHost, ".")
+	imageParts := strings.Split(imageHost, ".")
+	if len(patternParts) != len(imageParts) {
+		return false
+	}
+	for i := range patternParts {
+		if ok, err := path.Match(patternParts[i], imageParts[i]); err != nil || !ok {
+			return false
+		}
+	}
+
+	if patternPath == "" {
+		return true
+	}
+	return imagePath == patternPath || strings.HasPrefix(imagePath, patternPath+"/")
+}
@@ -0,0 +1,192 @@
+package credentialprovider
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `{"auths":{
+	"ghcr.io":{"username":"alex","password":"ghcr-token"},
+	"https://index.docker.io/v1/":{"auth":"ZG9ja2VyOmh1Yi10b2tlbg=="},
+	"registry.example.com/team":{"username":"team","password":"team-token"}
+}}`
+
+func Test_Provider_Run(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configFile, []byte(testConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	provider := &Provider{
+		ConfigFile:    configFile,
+		CacheDuration: 5 * time.Minute,
+	}
+
+	tests := []struct {
+		name    string
+		request string
+		want    string
+		wantErr string
+	}{
+		{
+			name:    "registry match",
+			request: `{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderRequest","image":"ghcr.io/alexellis/registry-creds:0.3.2"}`,
+			want:    `{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderResponse","cacheKeyType":"Registry","cacheDuration":"5m0s","auth":{"ghcr.io":{"username":"alex","password":"ghcr-token"}}}`,
+		},
+		{
+			name:    "image of the default registry with an auth field",
+			request: `{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderRequest","image":"nginx:latest"}`,
+			want:    `{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderResponse","cacheKeyType":"Registry","cacheDuration":"5m0s","auth":{"docker.io":{"username":"docker","password":"hub-token"}}}`,
+		},
+		{
+			name:    "path match is cached per image",
+			request: `{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderRequest","image":"registry.example.com/team/app@sha256:abc"}`,
+			want:    `{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderResponse","cacheKeyType":"Image","cacheDuration":"5m0s","auth":{"registry.example.com/team":{"username":"team","password":"team-token"}}}`,
+		},
+		{
+			name:    "path which does not match",
+			request: `{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderRequest","image":"registry.example.com/other/app"}`,
+			want:    `{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderResponse","cacheKeyType":"Registry","cacheDuration":"5m0s"}`,
+		},
+		{
+			name:    "no match",
+			request: `{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderRequest","image":"quay.io/team/app"}`,
+			want:    `{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderResponse","cacheKeyType":"Registry","cacheDuration":"5m0s"}`,
+		},
+		{
+			name:    "malformed request",
+			request: `{"apiVersion":`,
+			wantErr: "unable to parse request",
+		},
+		{
+			name:    "unsupported kind",
+			request: `{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"Pod","image":"ghcr.io/alexellis/app"}`,
+			wantErr: "unsupported request",
+		},
+		{
+			name:    "no image",
+			request: `{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderRequest"}`,
+			wantErr: "no image given in request",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			err := provider.Run(strings.NewReader(test.request), out)
+
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("want error containing %q, got: %v", test.wantErr, err)
+				}
+				if out.Len() > 0 {
+					t.Errorf("want no response on error, got: %s", out.String())
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := strings.TrimSpace(out.String()); got != test.want {
+				t.Errorf("want response:\n%s\ngot:\n%s", test.want, got)
+			}
+		})
+	}
+}
+
+func Test_Provider_Run_MalformedConfig(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configFile, []byte(`{"auths":`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	provider := &Provider{ConfigFile: configFile}
+
+	out := &bytes.Buffer{}
+	err := provider.Run(strings.NewReader(`{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderRequest","image":"ghcr.io/alexellis/app"}`), out)
+	if err == nil || !strings.Contains(err.Error(), "unable to parse") {
+		t.Fatalf("want an error parsing the config file, got: %v", err)
+	}
+}
+
+func Test_Sync(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(t.TempDir(), "config.json")
+
+	files := map[string]string{
+		"a.json":       `{"auths":{"ghcr.io":{"username":"a","password":"a"}}}`,
+		"b.json":       `{"auths":{"ghcr.io":{"username":"b","password":"b"},"quay.io":{"username":"b","password":"b"}}}`,
+		"..data":       `not json`,
+		"notes.txt":    `not json`,
+		".hidden.json": `not json`,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	written, err := Sync(dir, configFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !written {
+		t.Error("want the config file to be written")
+	}
+
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"auths":{"ghcr.io":{"username":"a","password":"a"},"quay.io":{"username":"b","password":"b"}}}`
+	if string(data) != want {
+		t.Errorf("want config:\n%s\ngot:\n%s", want, data)
+	}
+
+	info, err := os.Stat(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("want mode 0600, got: %s", info.Mode().Perm())
+	}
+
+	written, err = Sync(dir, configFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if written {
+		t.Error("want the config file not to be written again when unchanged")
+	}
+}
+
+func Test_Sync_MissingDir(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+
+	if _, err := Sync(filepath.Join(t.TempDir(), "missing"), configFile); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"auths":{}}` {
+		t.Errorf("want an empty config, got: %s", data)
+	}
+}
+
+func Test_entryCredentials_InvalidAuth(t *testing.T) {
+	_, _, err := entryCredentials(dockerConfigEntry{
+		Auth: base64.StdEncoding.EncodeToString([]byte("no-separator")),
+	})
+	if err == nil {
+		t.Fatal("want an error for an auth without a password")
+	}
+}
@@ -0,0 +1,90 @@
+package credentialprovider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Sync merges the .dockerconfigjson files in dir, which is the Secret
+// written by the controller with --credential-provider-secret mounted as
+// a volume, into the file read by the plugin. Each file holds the
+// credentials of one ClusterPullSecret, and where two hold the same
+// registry, the file which sorts first by name wins. The file is only
+// written when its contents change, and is replaced atomically so that
+// the plugin never reads a partially written file. Sync returns true
+// when the file was written.
+func Sync(dir, configFile string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("unable to read %s: %w", dir, err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		// Secret volumes hold their data in hidden ..data directories
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	merged := dockerConfigJSON{
+		Auths: map[string]dockerConfigEntry{},
+	}
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return false, fmt.Errorf("unable to read %s: %w", name, err)
+		}
+
+		config := dockerConfigJSON{}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return false, fmt.Errorf("unable to parse %s: %w", name, err)
+		}
+
+		for registry, entry := range config.Auths {
+			if _, ok := merged.Auths[registry]; !ok {
+				merged.Auths[registry] = entry
+			}
+		}
+	}
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return false, err
+	}
+
+	current, err := os.ReadFile(configFile)
+	if err == nil && bytes.Equal(current, data) {
+		return false, nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(configFile), ".registry-creds-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return false, err
+	}
+
+	if err := os.Rename(tmp.Name(), configFile); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,74 @@
+package credentialprovider
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// The types of the credentialprovider.kubelet.k8s.io/v1 exec protocol,
+// mirrored from k8s.io/kubelet/pkg/apis/credentialprovider/v1 so that the
+// plugin does not depend on the kubelet module.
+
+const (
+	// APIVersion is the only version of the protocol supported
+	APIVersion = "credentialprovider.kubelet.k8s.io/v1"
+
+	requestKind  = "CredentialProviderRequest"
+	responseKind = "CredentialProviderResponse"
+)
+
+// PluginCacheKeyType tells the kubelet how to cache a response
+type PluginCacheKeyType string
+
+const (
+	// ImagePluginCacheKeyType caches the response for the image only
+	ImagePluginCacheKeyType PluginCacheKeyType = "Image"
+
+	// RegistryPluginCacheKeyType caches the response for every image
+	// of the same registry
+	RegistryPluginCacheKeyType PluginCacheKeyType = "Registry"
+
+	// GlobalPluginCacheKeyType caches the response for every image
+	GlobalPluginCacheKeyType PluginCacheKeyType = "Global"
+)
+
+// CredentialProviderRequest is written to the stdin of the plugin by the kubelet
+type CredentialProviderRequest struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	// Image is the container image being pulled
+	Image string `json:"image"`
+}
+
+// CredentialProviderResponse is written to stdout by the plugin
+type CredentialProviderResponse struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	// CacheKeyType is how the kubelet caches the credentials
+	CacheKeyType PluginCacheKeyType `json:"cacheKeyType"`
+
+	// CacheDuration is how long the kubelet caches the credentials,
+	// formatted as a Go duration, i.e. 5m0s
+	CacheDuration *Duration `json:"cacheDuration,omitempty"`
+
+	// Auth maps image patterns, i.e. ghcr.io or *.azurecr.io/team,
+	// to the credentials used for matching images
+	Auth map[string]AuthConfig `json:"auth,omitempty"`
+}
+
+// AuthConfig holds the credentials of a registry
+type AuthConfig struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Duration is a time.Duration which is encoded as a string, i.e. 5m0s
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration.String())
+}
@@ -17,16 +17,23 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+	"k8s.io/client-go/tools/cache"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
 	corev1 "k8s.io/api/core/v1"
 
@@ -53,23 +60,84 @@ func init() {
 func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
+	var optIn bool
+	var credentialProviderSecret string
+	var enablePodWebhook bool
+	var enablePullSecretWebhook bool
+	var enableServiceAccountWebhook bool
+	var webhookPort int
+	var webhookCertDir string
+	var manageWebhookCerts bool
+	var webhookCertSecret string
+	var webhookService string
+	var webhookNamespace string
+	var mutatingWebhookConfiguration string
+	var validatingWebhookConfiguration string
 	flag.StringVar(&metricsAddr, "metrics-addr", ":9443", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.BoolVar(&optIn, "opt-in", false,
+		"Only provision namespaces annotated with alexellis.io/registry-creds.include, "+
+			"unless a ClusterPullSecret sets spec.mode.")
+	flag.StringVar(&credentialProviderSecret, "credential-provider-secret", "",
+		"Write the credentials of each ClusterPullSecret with spec.credentialProvider to this Secret, "+
+			"given as namespace/name, for the credential provider DaemonSet.")
+	flag.BoolVar(&enablePodWebhook, "enable-pod-webhook", false,
+		"Serve a mutating webhook which adds pull secrets to the imagePullSecrets of new Pods.")
+	flag.BoolVar(&enablePullSecretWebhook, "enable-clusterpullsecret-webhook", false,
+		"Serve webhooks which default and validate ClusterPullSecrets. "+
+			"They are also served when --enable-pod-webhook or --enable-serviceaccount-webhook is set.")
+	flag.BoolVar(&enableServiceAccountWebhook, "enable-serviceaccount-webhook", false,
+		"Serve a mutating webhook which adds pull secrets to the imagePullSecrets of new ServiceAccounts.")
+	flag.IntVar(&webhookPort, "webhook-port", 9444, "The port the webhook server binds to.")
+	flag.StringVar(&webhookCertDir, "webhook-cert-dir", "",
+		"The directory holding tls.crt and tls.key for the webhook server.")
+	flag.BoolVar(&manageWebhookCerts, "manage-webhook-certs", false,
+		"Generate and rotate a self-signed certificate for the webhook server, "+
+			"and patch the caBundle of its webhook configurations.")
+	flag.StringVar(&webhookCertSecret, "webhook-cert-secret", "registry-creds-webhook-certs",
+		"The Secret which holds the certificates generated with --manage-webhook-certs.")
+	flag.StringVar(&webhookService, "webhook-service", "registry-creds-webhook-service",
+		"The Service of the webhook server.")
+	flag.StringVar(&webhookNamespace, "webhook-namespace", "registry-creds-system",
+		"The namespace of the controller, its webhook Service and certificate Secret.")
+	flag.StringVar(&mutatingWebhookConfiguration, "mutating-webhook-configuration", "registry-creds-mutating-webhook-configuration",
+		"The MutatingWebhookConfiguration whose caBundle is patched with --manage-webhook-certs.")
+	flag.StringVar(&validatingWebhookConfiguration, "validating-webhook-configuration", "registry-creds-validating-webhook-configuration",
+		"The ValidatingWebhookConfiguration whose caBundle is patched with --manage-webhook-certs.")
 	flag.Parse()
 
 	z := zap.New(zap.UseDevMode(true)).V(2)
 	ctrl.SetLogger(z)
 
+	var credentialProviderSecretName types.NamespacedName
+	if credentialProviderSecret != "" {
+		namespace, name, err := cache.SplitMetaNamespaceKey(credentialProviderSecret)
+		if err != nil || namespace == "" || name == "" {
+			setupLog.Error(fmt.Errorf("expected namespace/name, got: %s", credentialProviderSecret),
+				"invalid --credential-provider-secret")
+			os.Exit(1)
+		}
+		credentialProviderSecretName = types.NamespacedName{Namespace: namespace, Name: name}
+	}
+
 	fmt.Printf("registry-creds - Copyright Alex Ellis, OpenFaaS Ltd 2024\n\n")
 
+	if webhookCertDir == "" {
+		webhookCertDir = filepath.Join(os.TempDir(), "k8s-webhook-server", "serving-certs")
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme: scheme,
 		Metrics: server.Options{
 
 			BindAddress: metricsAddr,
 		},
+		WebhookServer: webhook.NewServer(webhook.Options{
+			Port:    webhookPort,
+			CertDir: webhookCertDir,
+		}),
 		LeaderElection:   enableLeaderElection,
 		LeaderElectionID: "8bdecb1a.alexellis.io",
 	})
@@ -78,25 +146,37 @@ func main() {
 		os.Exit(1)
 	}
 
+	recorder := mgr.GetEventRecorderFor("registry-creds")
+
 	secretReconciler := &controllers.SecretReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("ClusterPullSecret"),
-		Scheme: mgr.GetScheme(),
+		Client:      mgr.GetClient(),
+		Log:         ctrl.Log.WithName("controllers").WithName("ClusterPullSecret"),
+		Scheme:      mgr.GetScheme(),
+		Recorder:    recorder,
+		DefaultMode: opsv1.ModeOptOut,
+	}
+	if optIn {
+		secretReconciler.DefaultMode = opsv1.ModeOptIn
 	}
 
 	if err = (&controllers.ClusterPullSecretReconciler{
 		Client:           mgr.GetClient(),
 		Log:              ctrl.Log.WithName("controllers").WithName("ClusterPullSecret"),
 		Scheme:           mgr.GetScheme(),
+		Recorder:         recorder,
 		SecretReconciler: secretReconciler,
+
+		CredentialProviderSecret: credentialProviderSecretName,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "ClusterPullSecret")
 		os.Exit(1)
 	}
 	if err = (&controllers.ServiceAccountWatcher{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("ServiceAccount"),
-		Scheme: mgr.GetScheme(),
+		Client:           mgr.GetClient(),
+		Log:              ctrl.Log.WithName("controllers").WithName("ServiceAccount"),
+		Scheme:           mgr.GetScheme(),
+		Recorder:         recorder,
+		SecretReconciler: secretReconciler,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "ServiceAccount")
 		os.Exit(1)
@@ -107,18 +187,81 @@ func main() {
 		Client:           mgr.GetClient(),
 		Log:              ctrl.Log.WithName("controllers").WithName("Namespace"),
 		Scheme:           mgr.GetScheme(),
+		Recorder:         recorder,
 		SecretReconciler: secretReconciler,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create watcher", "watcher", "Namespace")
 		os.Exit(1)
 	}
-	if err = (&controllers.ServiceAccountWatcher{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("ServiceAccount"),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "ServiceAccount")
-		os.Exit(1)
+
+	if enablePodWebhook {
+		mgr.GetWebhookServer().Register(controllers.PodWebhookPath, &webhook.Admission{
+			Handler: &controllers.PodInjector{
+				Client:           mgr.GetClient(),
+				Log:              ctrl.Log.WithName("webhooks").WithName("Pod"),
+				Decoder:          admission.NewDecoder(mgr.GetScheme()),
+				SecretReconciler: secretReconciler,
+			},
+		})
+	}
+
+	if enableServiceAccountWebhook {
+		mgr.GetWebhookServer().Register(controllers.ServiceAccountWebhookPath, &webhook.Admission{
+			Handler: &controllers.ServiceAccountInjector{
+				Client:           mgr.GetClient(),
+				Log:              ctrl.Log.WithName("webhooks").WithName("ServiceAccount"),
+				Decoder:          admission.NewDecoder(mgr.GetScheme()),
+				SecretReconciler: secretReconciler,
+			},
+		})
+	}
+
+	// The ClusterPullSecret webhooks use failurePolicy: Fail, and share their
+	// configurations with the Pod and ServiceAccount webhooks, so they are
+	// served whenever any webhook is enabled. Otherwise a configuration
+	// installed for one webhook would block every ClusterPullSecret.
+	enableWebhooks := enablePodWebhook || enableServiceAccountWebhook || enablePullSecretWebhook
+
+	if enableWebhooks {
+		if err = (&controllers.ClusterPullSecretWebhook{
+			Client:           mgr.GetClient(),
+			Log:              ctrl.Log.WithName("webhooks").WithName("ClusterPullSecret"),
+			SecretReconciler: secretReconciler,
+		}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "ClusterPullSecret")
+			os.Exit(1)
+		}
+	}
+
+	if manageWebhookCerts && enableWebhooks {
+		// The cache of the manager is not started yet, so read directly
+		certClient, err := client.New(mgr.GetConfig(), client.Options{Scheme: mgr.GetScheme()})
+		if err != nil {
+			setupLog.Error(err, "unable to create client for webhook certificates")
+			os.Exit(1)
+		}
+
+		certManager := &controllers.WebhookCertManager{
+			Client:      certClient,
+			Log:         ctrl.Log.WithName("webhooks").WithName("Certificates"),
+			SecretName:  webhookCertSecret,
+			Namespace:   webhookNamespace,
+			ServiceName: webhookService,
+			CertDir:     webhookCertDir,
+
+			MutatingWebhookConfiguration:   mutatingWebhookConfiguration,
+			ValidatingWebhookConfiguration: validatingWebhookConfiguration,
+		}
+
+		// Certificates are needed before the webhook server starts
+		if err := certManager.Sync(context.Background()); err != nil {
+			setupLog.Error(err, "unable to sync webhook certificates")
+			os.Exit(1)
+		}
+		if err := mgr.Add(certManager); err != nil {
+			setupLog.Error(err, "unable to add webhook certificate manager")
+			os.Exit(1)
+		}
 	}
 
 	// +kubebuilder:scaffold:builder